@@ -2,7 +2,6 @@ package database
 
 import (
 	"context"
-	"errors"
 	"flag"
 	"fmt"
 	"net/rpc"
@@ -20,7 +19,6 @@ import (
 	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/hashicorp/vault/sdk/queue"
-	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog"
 )
 
@@ -77,21 +75,27 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 	klogger := conf.Logger.Named("klog")
 	klog.SetOutput(klogger.StandardWriter(&log.StandardLoggerOptions{ForceLevel: log.Debug}))
 
-	kubeconfig, err := b.kubeconfig(ctx, conf.StorageView)
+	clusters, err := b.clusters(ctx, conf.StorageView)
 	if err != nil {
 		// don't kill startup, otherwise we won't get an opportunity to fix the config
-		conf.Logger.Error("Error loading kubeconfig: %v", err)
+		conf.Logger.Error("Error listing kubeconfigs", "error", err)
 		return b, nil
 	}
 
-	if kubeconfig != nil {
-		stop, err := b.watchServiceAccounts(kubeconfig)
+	for _, cluster := range clusters {
+		kubeconfig, err := b.kubeconfig(ctx, conf.StorageView, cluster)
 		if err != nil {
-			conf.Logger.Error("Error creating client to watch service accounts: %v", err)
-			return b, nil
+			conf.Logger.Error("Error loading kubeconfig", "cluster", clusterDisplayName(cluster), "error", err)
+			continue
 		}
 
-		b.stopWatch = stop
+		if kubeconfig == nil {
+			continue
+		}
+
+		if err := b.startWatcher(conf.StorageView, cluster, kubeconfig); err != nil {
+			conf.Logger.Error("Error creating client to watch service accounts", "cluster", clusterDisplayName(cluster), "error", err)
+		}
 	}
 
 	return b, nil
@@ -105,11 +109,13 @@ func Backend(conf *logical.BackendConfig) *databaseBackend {
 		PathsSpecial: &logical.Paths{
 			LocalStorage: []string{
 				framework.WALPrefix,
+				localMappingPath,
 			},
 			SealWrapStorage: []string{
 				"config/*",
 				"static-role/*",
 				kubeconfigPath,
+				kubeconfigPath + "/*",
 			},
 		},
 		Paths: framework.PathAppend(
@@ -121,8 +127,14 @@ func Backend(conf *logical.BackendConfig) *databaseBackend {
 			pathListRoles(&b),
 			pathRoles(&b),
 			pathCredsCreate(&b),
+			pathKubernetesCreds(&b),
 			pathRotateCredentials(&b),
+			// the status and reconcile paths must come first, as they would otherwise match
+			// kubeconfig/<name> with one of the reservedClusterNames
+			pathKubeconfigStatus(&b),
+			pathKubeconfigReconcile(&b),
 			pathKubeconfig(&b),
+			pathServiceAccounts(&b),
 		),
 
 		Secrets: []*framework.Secret{
@@ -139,7 +151,8 @@ func Backend(conf *logical.BackendConfig) *databaseBackend {
 	b.connections = make(map[string]*dbPluginInstance)
 
 	b.roleLocks = locksutil.CreateLocks()
-	b.saCache = cache.NewStore(keyFunc)
+	b.watchers = make(map[string]*serviceAccountWatcher)
+	b.storageView = conf.StorageView
 
 	return &b
 }
@@ -165,9 +178,12 @@ type databaseBackend struct {
 	// issues with the priority queue.
 	roleLocks []*locksutil.LockEntry
 
-	saCache   cache.Store
-	stopWatch func()
-	stopMtx   sync.Mutex
+	// watchers holds the service account watcher of each configured Kubernetes
+	// cluster, keyed by cluster name. The default cluster has an empty name.
+	watchers map[string]*serviceAccountWatcher
+	watchMtx sync.RWMutex
+	// storageView is used to restart watchers when their config is invalidated
+	storageView logical.Storage
 }
 
 func (b *databaseBackend) DatabaseConfig(ctx context.Context, s logical.Storage, name string) (*DatabaseConfig, error) {
@@ -204,17 +220,24 @@ type upgradeCheck struct {
 
 // getKubernetesRoleEntry should be called if a role is prefixed with k8s_ and is not found in storage.
 // In this case, we should look up the underlying concrete role eg rw in k8s_rw_s-ledger_default, and
-// then look up the appropriate service account to interpolate its annotation into the creation statements.
+// then look up the appropriate service account to interpolate its annotation into the statements of the
+// concrete role. Roles prefixed with k8s-<cluster>_ look up the service account in the named cluster instead.
 func (b *databaseBackend) getKubernetesRoleEntry(ctx context.Context, s logical.Storage, name string, pathPrefix string) (*roleEntry, error) {
-	// turn k8s_rw_s-ledger-default into [k8s, rw, s-ledger, default]
-	subs := strings.SplitN(name, "_", 4)
-	if len(subs) < 4 {
-		return nil, errors.New("k8s role name is malformed; must be in format k8s_role_service-account-name_namespace")
+	k8sName, err := parseKubernetesRoleName(name)
+	if err != nil {
+		// a name which is not a valid virtual role is simply an unknown role
+		b.logger.Debug("not a virtual role", "role", name, "error", err)
+		return nil, nil
 	}
 
-	roleName, svcAccountName, namespace := subs[1], subs[2], subs[3]
+	return b.resolveKubernetesRole(ctx, s, k8sName, pathPrefix)
+}
 
-	role, err := b.roleAtPath(ctx, s, roleName, pathPrefix)
+// resolveKubernetesRole applies the annotations of a service account, or its DatabaseAccess
+// resources, to a concrete role. A nil role is returned if either the concrete role or the
+// service account's annotation or grant is missing.
+func (b *databaseBackend) resolveKubernetesRole(ctx context.Context, s logical.Storage, k8sName *k8sRoleName, pathPrefix string) (*roleEntry, error) {
+	role, err := b.roleAtPath(ctx, s, k8sName.Role, pathPrefix)
 	if err != nil {
 		return nil, err
 	}
@@ -223,40 +246,80 @@ func (b *databaseBackend) getKubernetesRoleEntry(ctx context.Context, s logical.
 		return nil, nil
 	}
 
-	annotation, dbName, err := b.getServiceAccountAnnotations(ctx, s, namespace, svcAccountName)
+	if role.StaticAccount != nil && role.StaticAccount.KubernetesTemplate {
+		// static roles are only provisioned from a template when service accounts are
+		// synced, so this service account has not been provisioned yet
+		return nil, nil
+	}
+
+	mapping, err := b.kubernetesMapping(ctx, s, k8sName)
 	if err != nil {
 		return nil, err
 	}
 
-	if annotation == "" {
-		// no service account with an annotation found
+	if mapping == nil || mapping.Keyspace == "" {
+		// no service account with an annotation or grant found
 		return nil, nil
 	}
 
-	if dbName != "" {
-		// Override the default DB Name for the role
-		role.DBName = dbName
+	config, err := b.kubeconfig(ctx, s, k8sName.Cluster)
+	if err != nil {
+		return nil, err
 	}
-
-	transformation := map[string]string{
-		"annotation": annotation,
+	if err := checkAnnotationPattern(k8sName, role, config, mapping); err != nil {
+		return nil, err
 	}
 
-	var transformedStatements []string
+	role.kubernetesName = k8sName
+	role.kubernetesMapping = mapping
 
-	for _, statement := range role.Statements.Creation {
-		transformedStatements = append(transformedStatements, dbutil.QueryHelper(statement, transformation))
+	if mapping.DBName != "" {
+		// Override the default DB Name for the role
+		if err := role.checkDBNameOverride(k8sName, mapping.DBName); err != nil {
+			return nil, err
+		}
+		role.DBName = mapping.DBName
+	}
+
+	// Every kind of statement is expanded, so that revocation, renewal and rollback can
+	// refer to the keyspaces granted on creation
+	for _, statements := range []*[]string{
+		&role.Statements.Creation,
+		&role.Statements.Revocation,
+		&role.Statements.Renewal,
+		&role.Statements.Rollback,
+	} {
+		*statements, err = expandStatements(*statements, k8sName, mapping)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	role.Statements.Creation = transformedStatements
-
-	// For backwards compatibility, copy the transformed value back into the string form
-	// of the field
+	// For backwards compatibility, copy the transformed values back into the string form
+	// of the fields
 	role.Statements.CreationStatements = strings.Join(role.Statements.Creation, ";")
+	role.Statements.RevocationStatements = strings.Join(role.Statements.Revocation, ";")
+	role.Statements.RenewStatements = strings.Join(role.Statements.Renewal, ";")
+	role.Statements.RollbackStatements = strings.Join(role.Statements.Rollback, ";")
 
 	return role, nil
 }
 
+// checkDBNameOverride returns an error if a service account's db name annotation may not
+// redirect the concrete role to the given database
+func (r *roleEntry) checkDBNameOverride(k8sName *k8sRoleName, dbName string) error {
+	if len(r.AllowedDBNameOverrides) == 0 || dbName == r.DBName {
+		return nil
+	}
+
+	if !strutil.StrListContainsGlob(r.AllowedDBNameOverrides, dbName) {
+		return fmt.Errorf("service account %s/%s may not override the database of role %q to %q; allowed_db_name_overrides is %q",
+			k8sName.Namespace, k8sName.ServiceAccount, k8sName.Role, dbName, r.AllowedDBNameOverrides)
+	}
+
+	return nil
+}
+
 func (b *databaseBackend) Role(ctx context.Context, s logical.Storage, roleName string) (*roleEntry, error) {
 	return b.roleAtPath(ctx, s, roleName, databaseRolePath)
 }
@@ -271,7 +334,7 @@ func (b *databaseBackend) roleAtPath(ctx context.Context, s logical.Storage, rol
 		return nil, err
 	}
 	if entry == nil {
-		if strings.HasPrefix(roleName, "k8s_") {
+		if isKubernetesRoleName(roleName) {
 			return b.getKubernetesRoleEntry(ctx, s, roleName, pathPrefix)
 		}
 		return nil, nil
@@ -319,6 +382,20 @@ func (b *databaseBackend) invalidate(ctx context.Context, key string) {
 	case strings.HasPrefix(key, databaseConfigPath):
 		name := strings.TrimPrefix(key, databaseConfigPath)
 		b.ClearConnection(name)
+	case key == kubeconfigPath, strings.HasPrefix(key, kubeconfigPath+"/"):
+		// the config was changed on the active node, so this node's watcher must follow
+		cluster := strings.TrimPrefix(strings.TrimPrefix(key, kubeconfigPath), "/")
+		if err := b.reloadWatcher(ctx, b.storageView, cluster); err != nil {
+			b.logger.Error("error reloading service account watcher", "cluster", clusterDisplayName(cluster), "error", err)
+		}
+	default:
+		if cluster, ok := serviceAccountStorageCluster(key); ok {
+			// the replicated mapping no longer matches what this node's watcher last wrote,
+			// unless this node keeps a local mapping and so never wrote it
+			if w := b.watcher(cluster); w != nil && w.mirror != nil && !usesLocalMapping(b.System(), w.mirror.config) {
+				w.mirror.requestReconcile()
+			}
+		}
 	}
 }
 
@@ -442,11 +519,7 @@ func (b *databaseBackend) clean(ctx context.Context) {
 	}
 	b.connections = make(map[string]*dbPluginInstance)
 
-	b.stopMtx.Lock()
-	defer b.stopMtx.Unlock()
-	if b.stopWatch != nil {
-		b.stopWatch()
-	}
+	b.stopWatchers()
 }
 
 const backendHelp = `
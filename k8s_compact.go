@@ -0,0 +1,89 @@
+package database
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// retainedMetadata lists the annotations and labels of service accounts which the plugin reads.
+// Everything else is dropped before service accounts are cached.
+type retainedMetadata struct {
+	annotations []string
+	labels      []string
+}
+
+// retainedMetadata returns the annotation and label keys read under a config
+func (c *kubeConfig) retainedMetadata() *retainedMetadata {
+	retained := &retainedMetadata{
+		annotations: []string{c.KeyspaceAnnotation, c.DBNameAnnotation},
+	}
+	for _, key := range c.AnnotationVariables {
+		retained.annotations = append(retained.annotations, key)
+	}
+	for _, key := range c.LabelVariables {
+		retained.labels = append(retained.labels, key)
+	}
+	return retained
+}
+
+// compact returns a copy of a service account or namespace holding only its identity, resource version and
+// the retained annotations and labels. Secrets, image pull secrets, managed fields and every
+// other annotation are dropped, so the cache scales with what the plugin reads.
+func (r *retainedMetadata) compact(obj interface{}) interface{} {
+	switch obj := obj.(type) {
+	case *v1.ServiceAccount:
+		return &v1.ServiceAccount{ObjectMeta: r.compactMeta(&obj.ObjectMeta)}
+	case *v1.Namespace:
+		return &v1.Namespace{ObjectMeta: r.compactMeta(&obj.ObjectMeta)}
+	}
+	return obj
+}
+
+func (r *retainedMetadata) compactMeta(objMeta *metav1.ObjectMeta) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Namespace:       objMeta.Namespace,
+		Name:            objMeta.Name,
+		UID:             objMeta.UID,
+		ResourceVersion: objMeta.ResourceVersion,
+		Annotations:     retainKeys(objMeta.Annotations, r.annotations),
+		Labels:          retainKeys(objMeta.Labels, r.labels),
+	}
+}
+
+func retainKeys(values map[string]string, keys []string) map[string]string {
+	var retained map[string]string
+	for _, key := range keys {
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
+		if retained == nil {
+			retained = map[string]string{}
+		}
+		retained[key] = value
+	}
+	return retained
+}
+
+// compactStore wraps the cache to compact service accounts as they are stored
+type compactStore struct {
+	cache.Store
+	retained *retainedMetadata
+}
+
+func (s *compactStore) Add(obj interface{}) error {
+	return s.Store.Add(s.retained.compact(obj))
+}
+
+func (s *compactStore) Update(obj interface{}) error {
+	return s.Store.Update(s.retained.compact(obj))
+}
+
+func (s *compactStore) Replace(list []interface{}, resourceVersion string) error {
+	compacted := make([]interface{}, 0, len(list))
+	for _, obj := range list {
+		compacted = append(compacted, s.retained.compact(obj))
+	}
+	return s.Store.Replace(compacted, resourceVersion)
+}
@@ -2,52 +2,538 @@ package database
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"path"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/database/helper/dbutil"
 	"github.com/hashicorp/vault/sdk/logical"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/dynamic"
 	clientset "k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 )
 
+const (
+	serviceAccountPath = "serviceaccount/"
+	clusterPath        = "cluster/"
+)
+
+// serviceAccountStoragePrefix returns the storage prefix under which the service account
+// mapping for a cluster is persisted. The default cluster keeps the original serviceaccount/
+// prefix so that existing mappings remain valid.
+func serviceAccountStoragePrefix(cluster string) string {
+	if cluster == "" {
+		return serviceAccountPath
+	}
+	return clusterPath + cluster + "/" + serviceAccountPath
+}
+
+// credentialRefreshInterval is how often credentials read from files are checked for changes
+const credentialRefreshInterval = time.Minute
+
+// serviceAccountStorageCluster returns the cluster whose replicated mapping a storage key
+// belongs to, if it belongs to one
+func serviceAccountStorageCluster(key string) (string, bool) {
+	if strings.HasPrefix(key, serviceAccountPath) {
+		return "", true
+	}
+
+	subs := strings.SplitN(strings.TrimPrefix(key, clusterPath), "/", 2)
+	if strings.HasPrefix(key, clusterPath) && len(subs) == 2 && strings.HasPrefix(subs[1], serviceAccountPath) {
+		return subs[0], true
+	}
+
+	return "", false
+}
+
+// serviceAccountWatcher holds the in-memory cache of service accounts for a single
+// Kubernetes cluster, along with the reflector which keeps it up to date.
+type serviceAccountWatcher struct {
+	cache  cache.Store
+	logger log.Logger
+	status watcherStatus
+
+	// retained lists the metadata kept when service accounts are cached. If nil, service
+	// accounts are cached whole.
+	retained *retainedMetadata
+
+	// namespaces caches the namespaces of the cluster, if their annotations are used as
+	// defaults for the service accounts in them
+	namespaces cache.Store
+
+	// grants caches the DatabaseAccess resources of the cluster, if they grant access rather
+	// than service account annotations, indexed by the virtual role they grant
+	grants cache.Indexer
+
+	// events records Kubernetes Events against service accounts, if enabled
+	events *eventRecorder
+	// mirror persists changes to the cache as they are observed
+	mirror *serviceAccountMirror
+
+	// stopCh is closed when the watcher is stopped
+	stopCh chan struct{}
+
+	// reflectors are the currently running reflectors, keyed by the namespace they watch,
+	// which are replaced whenever the credentials change. They are stopped by closing
+	// reflectorStopCh.
+	reflectors      map[string]*cache.Reflector
+	reflectorStopCh chan struct{}
+	reflectorMtx    sync.Mutex
+	// grantClient updates the status of DatabaseAccess resources with the current credentials
+	grantClient dynamic.NamespaceableResourceInterface
+}
+
 // watchServiceAccounts is called on plugin start and attempts to maintain an
-// in-memory cache of all service accounts.
-func (b *databaseBackend) watchServiceAccounts(kubeconfig *kubeConfig) (func(), error) {
-	b.logger.Info("kubeconfig provided; will watch for Kubernetes service accounts")
+// in-memory cache of all service accounts in the given cluster.
+func (b *databaseBackend) watchServiceAccounts(s logical.Storage, cluster string, kubeconfig *kubeConfig) (*serviceAccountWatcher, error) {
+	w := &serviceAccountWatcher{
+		cache:  cache.NewStore(keyFunc),
+		logger: b.logger.With("cluster", clusterDisplayName(cluster)),
+		stopCh: make(chan struct{}),
+	}
+	expected := kubeconfig.watchedNamespaces()
+	if kubeconfig.NamespaceDefaults {
+		w.namespaces = cache.NewStore(cache.MetaNamespaceKeyFunc)
+		expected = append(expected, namespacesReflectorKey)
+	}
+	if kubeconfig.grantsFromResources() {
+		w.grants = newDatabaseAccessIndexer()
+		for _, namespace := range kubeconfig.watchedNamespaces() {
+			expected = append(expected, grantsReflectorKey+namespace)
+		}
+	} else {
+		// There is no mapping to persist when access is granted by DatabaseAccess resources
+		w.mirror = newServiceAccountMirror(b, s, cluster, kubeconfig, w.cache)
+		w.mirror.namespaces = w.namespaces
+	}
+	w.status.expectNamespaces(expected)
+	w.retained = kubeconfig.retainedMetadata()
 
-	config := &rest.Config{
-		Host:        kubeconfig.Host,
-		BearerToken: kubeconfig.JWT,
-		TLSClientConfig: rest.TLSClientConfig{
-			CAData: []byte(kubeconfig.CACert),
-		},
+	w.logger.Info("kubeconfig provided; will watch for Kubernetes service accounts")
+
+	if kubeconfig.RecordEvents {
+		w.events = newEventRecorder(w.logger)
 	}
 
-	client, err := clientset.NewForConfig(config)
+	creds, err := kubeconfig.credentials()
 	if err != nil {
 		return nil, err
 	}
 
-	lw := cache.NewListWatchFromClient(client.CoreV1().RESTClient(), "serviceaccounts", "", fields.Everything())
+	if err := w.startReflector(kubeconfig, creds); err != nil {
+		return nil, err
+	}
+
+	if w.mirror != nil {
+		go w.mirror.run(w.stopCh)
+	}
+
+	if kubeconfig.reloadsCredentials() {
+		go w.refreshCredentials(kubeconfig, creds)
+	}
+
+	return w, nil
+}
+
+// startReflector builds a client from the given credentials and starts a reflector for each
+// watched namespace populating the watcher's cache, stopping any previous reflectors.
+func (w *serviceAccountWatcher) startReflector(kubeconfig *kubeConfig, creds *kubeCredentials) error {
+	restConfig := kubeconfig.tuneRestConfig(creds.restConfig())
+	client, err := clientset.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+
+	// The request timeout must not apply to watches, which are held open
+	watchConfig := *restConfig
+	watchConfig.Timeout = 0
+	watchClient, err := clientset.NewForConfig(&watchConfig)
+	if err != nil {
+		return err
+	}
+
+	optionsModifier := func(options *metav1.ListOptions) {
+		options.LabelSelector = kubeconfig.LabelSelector
+		options.FieldSelector = kubeconfig.FieldSelector
+	}
+
+	listerWatchers := map[string]cache.ListerWatcher{}
+	for _, namespace := range kubeconfig.watchedNamespaces() {
+		listLW := cache.NewFilteredListWatchFromClient(client.CoreV1().RESTClient(), "serviceaccounts", namespace, optionsModifier)
+		watchLW := cache.NewFilteredListWatchFromClient(watchClient.CoreV1().RESTClient(), "serviceaccounts", namespace, optionsModifier)
+		listerWatchers[namespace] = &cache.ListWatch{ListFunc: listLW.ListFunc, WatchFunc: watchLW.WatchFunc}
+	}
 
-	reflector := cache.NewReflector(lw, &v1.ServiceAccount{}, b.saCache, time.Hour)
+	var namespaceListerWatcher cache.ListerWatcher
+	if w.namespaces != nil {
+		listLW := cache.NewListWatchFromClient(client.CoreV1().RESTClient(), "namespaces", metav1.NamespaceAll, fields.Everything())
+		watchLW := cache.NewListWatchFromClient(watchClient.CoreV1().RESTClient(), "namespaces", metav1.NamespaceAll, fields.Everything())
+		namespaceListerWatcher = &cache.ListWatch{ListFunc: listLW.ListFunc, WatchFunc: watchLW.WatchFunc}
+	}
+
+	var grantListerWatchers map[string]cache.ListerWatcher
+	if w.grants != nil {
+		grantClient, err := dynamic.NewForConfig(restConfig)
+		if err != nil {
+			return err
+		}
+		grantWatchClient, err := dynamic.NewForConfig(&watchConfig)
+		if err != nil {
+			return err
+		}
+
+		grantListerWatchers = map[string]cache.ListerWatcher{}
+		for _, namespace := range kubeconfig.watchedNamespaces() {
+			grantListerWatchers[namespace] = databaseAccessListerWatcher(grantClient, grantWatchClient, namespace)
+		}
+
+		w.reflectorMtx.Lock()
+		w.grantClient = grantClient.Resource(databaseAccessResource)
+		w.reflectorMtx.Unlock()
+	}
+
+	w.events.setClient(client.CoreV1())
+	w.runReflectors(listerWatchers, namespaceListerWatcher, grantListerWatchers, kubeconfig.resyncPeriod())
+
+	return nil
+}
+
+// runReflectors starts a reflector from each of the given ListerWatchers of service accounts
+// and of DatabaseAccess resources, keyed by the namespace they list, and one from the
+// ListerWatcher of namespaces if it is not nil, stopping any previous reflectors. Every
+// resyncPeriod, if it is not 0, each reflector relists.
+func (w *serviceAccountWatcher) runReflectors(listerWatchers map[string]cache.ListerWatcher, namespaceListerWatcher cache.ListerWatcher, grantListerWatchers map[string]cache.ListerWatcher, resyncPeriod time.Duration) {
+	reflectors := map[string]*cache.Reflector{}
+	if namespaceListerWatcher != nil {
+		var store cache.Store = w.namespaces
+		if w.retained != nil {
+			store = &compactStore{Store: store, retained: w.retained}
+		}
+		if w.mirror != nil {
+			store = &namespaceEventStore{Store: store, mirror: w.mirror}
+		}
+		store = &statusStore{Store: store, status: &w.status, namespace: namespacesReflectorKey}
+		store = &relistStore{Store: store}
+		lw := &statusListerWatcher{ListerWatcher: namespaceListerWatcher, status: &w.status}
+		reflectors[namespacesReflectorKey] = cache.NewReflector(lw, &v1.Namespace{}, store, resyncPeriod)
+	}
+
+	for namespace, listerWatcher := range listerWatchers {
+		lw := &statusListerWatcher{
+			ListerWatcher: listerWatcher,
+			status:        &w.status,
+		}
+
+		var store cache.Store = w.cache
+		if w.retained != nil {
+			store = &compactStore{Store: store, retained: w.retained}
+		}
+		store = &namespaceStore{Store: store, namespace: namespace}
+		if w.mirror != nil {
+			store = &mirrorStore{Store: store, mirror: w.mirror}
+		}
+		store = &statusStore{Store: store, status: &w.status, namespace: namespace}
+		store = &relistStore{Store: store}
+		reflectors[namespace] = cache.NewReflector(lw, &v1.ServiceAccount{}, store, resyncPeriod)
+	}
+
+	for namespace, listerWatcher := range grantListerWatchers {
+		lw := &statusListerWatcher{
+			ListerWatcher: listerWatcher,
+			status:        &w.status,
+		}
+
+		var store cache.Store = &namespaceStore{Store: w.grants, namespace: namespace}
+		store = &statusStore{Store: store, status: &w.status, namespace: grantsReflectorKey + namespace}
+		store = &relistStore{Store: store}
+		reflectors[grantsReflectorKey+namespace] = cache.NewReflector(lw, &unstructured.Unstructured{}, store, resyncPeriod)
+	}
+
+	w.reflectorMtx.Lock()
+	defer w.reflectorMtx.Unlock()
+
+	if w.reflectorStopCh != nil {
+		close(w.reflectorStopCh)
+	}
 
 	stopCh := make(chan struct{})
-	go reflector.Run(stopCh)
+	w.reflectors = reflectors
+	w.reflectorStopCh = stopCh
+	for _, reflector := range reflectors {
+		go reflector.Run(stopCh)
+	}
+}
+
+// lastSyncResourceVersions are the resource versions last observed by the current
+// reflectors, keyed by the namespace they watch
+func (w *serviceAccountWatcher) lastSyncResourceVersions() map[string]string {
+	w.reflectorMtx.Lock()
+	defer w.reflectorMtx.Unlock()
+
+	versions := make(map[string]string, len(w.reflectors))
+	for namespace, reflector := range w.reflectors {
+		versions[namespace] = reflector.LastSyncResourceVersion()
+	}
+	return versions
+}
 
-	return func() {
-		b.logger.Info("Closing reflector")
-		close(stopCh)
+// errRelist ends the watch of a reflector when its resync period elapses
+var errRelist = errors.New("resync period elapsed, relisting")
+
+// relistStore turns the periodic resync of a reflector into a relist. The stores behind the
+// reflectors have nothing to resync, so instead the watch is ended and the reflector lists
+// again, replacing the cache and with it any change a watch missed.
+type relistStore struct {
+	cache.Store
+}
+
+func (s *relistStore) Resync() error {
+	return errRelist
+}
+
+// namespaceStore scopes the reflector of a single namespace to that namespace of the shared
+// cache, so that relisting one namespace does not remove the service accounts of the others
+type namespaceStore struct {
+	cache.Store
+	// namespace is empty if every namespace is watched by a single reflector
+	namespace string
+}
+
+func (s *namespaceStore) Replace(list []interface{}, resourceVersion string) error {
+	if s.namespace == metav1.NamespaceAll {
+		return s.Store.Replace(list, resourceVersion)
+	}
+
+	listed := make(map[string]struct{}, len(list))
+	for _, obj := range list {
+		key, err := keyFunc(obj)
+		if err != nil {
+			return err
+		}
+		listed[key] = struct{}{}
+
+		if err := s.Store.Update(obj); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range s.Store.ListKeys() {
+		if _, ok := listed[key]; ok || !strings.HasPrefix(key, s.namespace+"/") {
+			continue
+		}
+
+		obj, exists, err := s.Store.GetByKey(key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if err := s.Store.Delete(obj); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// refreshCredentials periodically re-reads credentials which are stored in files, and
+// restarts the reflector with a new client if they have changed. The cache is kept, so
+// lookups continue to be served while the new reflector lists service accounts.
+func (w *serviceAccountWatcher) refreshCredentials(kubeconfig *kubeConfig, current *kubeCredentials) {
+	ticker := time.NewTicker(credentialRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		creds, err := kubeconfig.credentials()
+		if err != nil {
+			w.logger.Error("error refreshing Kubernetes credentials", "error", err)
+			continue
+		}
+
+		if *creds == *current {
+			continue
+		}
+
+		w.logger.Info("Kubernetes credentials changed; restarting reflector")
+		if err := w.startReflector(kubeconfig, creds); err != nil {
+			w.logger.Error("error restarting reflector", "error", err)
+			continue
+		}
+		current = creds
+	}
+}
+
+// stop closes the reflector and ends any credential refreshing
+func (w *serviceAccountWatcher) stop() {
+	w.logger.Info("Closing reflector")
+	close(w.stopCh)
+
+	w.reflectorMtx.Lock()
+	defer w.reflectorMtx.Unlock()
+
+	if w.reflectorStopCh != nil {
+		close(w.reflectorStopCh)
+		w.reflectorStopCh = nil
+	}
+}
+
+// startWatcher replaces any running watcher for the cluster with a new one using the given config
+func (b *databaseBackend) startWatcher(s logical.Storage, cluster string, kubeconfig *kubeConfig) error {
+	b.watchMtx.Lock()
+	defer b.watchMtx.Unlock()
+
+	if w, ok := b.watchers[cluster]; ok {
+		w.stop()
+		delete(b.watchers, cluster)
+	}
+
+	if !b.watchesServiceAccounts(kubeconfig) {
+		b.logger.Info("not watching service accounts on this node, the mapping will be read from storage", "cluster", clusterDisplayName(cluster))
+		return nil
+	}
+
+	w, err := b.watchServiceAccounts(s, cluster, kubeconfig)
+	if err != nil {
+		return err
+	}
+	b.watchers[cluster] = w
+
+	return nil
+}
+
+// stopWatcher stops the reflector of a cluster, if it is being watched
+func (b *databaseBackend) stopWatcher(cluster string) {
+	b.watchMtx.Lock()
+	defer b.watchMtx.Unlock()
+
+	if w, ok := b.watchers[cluster]; ok {
+		w.stop()
+		delete(b.watchers, cluster)
+	}
+}
+
+// reloadWatcher restarts the watcher of a cluster from its stored config, or stops it if the
+// config has been deleted
+func (b *databaseBackend) reloadWatcher(ctx context.Context, s logical.Storage, cluster string) error {
+	kubeconfig, err := b.kubeconfig(ctx, s, cluster)
+	if err != nil {
+		return err
+	}
+
+	if kubeconfig == nil {
+		b.stopWatcher(cluster)
+		return nil
+	}
+
+	return b.startWatcher(s, cluster, kubeconfig)
+}
+
+// stopWatchers stops the reflectors of every cluster
+func (b *databaseBackend) stopWatchers() {
+	b.watchMtx.Lock()
+	defer b.watchMtx.Unlock()
+
+	for cluster, w := range b.watchers {
+		w.stop()
+		delete(b.watchers, cluster)
+	}
+}
+
+// watcher returns the service account watcher for a cluster, or nil if the cluster
+// is not being watched.
+func (b *databaseBackend) watcher(cluster string) *serviceAccountWatcher {
+	b.watchMtx.RLock()
+	defer b.watchMtx.RUnlock()
+
+	return b.watchers[cluster]
+}
+
+// serviceAccountCache returns the service account cache for a cluster, or nil if
+// the cluster is not being watched.
+func (b *databaseBackend) serviceAccountCache(cluster string) cache.Store {
+	if w := b.watcher(cluster); w != nil {
+		return w.cache
+	}
+	return nil
+}
+
+// clusterDisplayName is used in logs and errors to refer to the unnamed default cluster
+func clusterDisplayName(cluster string) string {
+	if cluster == "" {
+		return "default"
+	}
+	return cluster
+}
+
+// k8sRoleName identifies a virtual role: a concrete role applied to a service account
+// in a given cluster.
+type k8sRoleName struct {
+	Cluster        string
+	Role           string
+	ServiceAccount string
+	Namespace      string
+}
+
+// parseKubernetesRoleName splits a virtual role name into its components. Names take
+// the form k8s_rw_s-ledger_default for the default cluster, or k8s-prod_rw_s-ledger_default
+// for a cluster named prod. Kubernetes names cannot contain underscores, so the service
+// account and namespace are taken from the end and the concrete role may contain underscores.
+func parseKubernetesRoleName(name string) (*k8sRoleName, error) {
+	// turn k8s_rw_s-ledger_default into [k8s, rw, s-ledger, default]
+	subs := strings.Split(name, "_")
+	if len(subs) < 4 {
+		return nil, errors.New("k8s role name is malformed; must be in format k8s_role_service-account-name_namespace or k8s-cluster_role_service-account-name_namespace")
+	}
+
+	var cluster string
+	switch {
+	case subs[0] == "k8s":
+	case strings.HasPrefix(subs[0], "k8s-") && len(subs[0]) > len("k8s-"):
+		cluster = strings.TrimPrefix(subs[0], "k8s-")
+	default:
+		return nil, fmt.Errorf("k8s role name %q has an unknown prefix %q", name, subs[0])
+	}
+
+	return &k8sRoleName{
+		Cluster:        cluster,
+		Role:           strings.Join(subs[1:len(subs)-2], "_"),
+		ServiceAccount: subs[len(subs)-2],
+		Namespace:      subs[len(subs)-1],
 	}, nil
 }
 
+// String formats the virtual role name, the inverse of parseKubernetesRoleName
+func (n *k8sRoleName) String() string {
+	prefix := "k8s"
+	if n.Cluster != "" {
+		prefix = "k8s-" + n.Cluster
+	}
+	return strings.Join([]string{prefix, n.Role, n.ServiceAccount, n.Namespace}, "_")
+}
+
+// isKubernetesRoleName reports whether a role name could refer to a virtual role
+func isKubernetesRoleName(name string) bool {
+	return strings.HasPrefix(name, "k8s_") || strings.HasPrefix(name, "k8s-")
+}
+
 // keyFunc is very similar to cache.MetaNamespaceKeyFunc except when
 // there's no namespace specified it uses "default"
 func keyFunc(obj interface{}) (string, error) {
@@ -61,158 +547,600 @@ func keyFunc(obj interface{}) (string, error) {
 	return "default/" + meta.GetName(), nil
 }
 
-const nameRegexStr = `^[\w.]+$`
+// defaultAnnotationPattern is the annotation_pattern used when neither the concrete role nor
+// the kubeconfig sets one. It is fairly restrictive to avoid injection.
+const defaultAnnotationPattern = `^[\w.]+$`
+
+const variableNameRegexStr = `^[\w.]+$`
+
+// variableNameRegex restricts the names of template variables
+var variableNameRegex = regexp.MustCompile(variableNameRegexStr)
+
+// rolePattern returns the annotation_pattern which applies to a concrete role: that of the
+// role, or else of the kubeconfig
+func rolePattern(role *roleEntry, config *kubeConfig) string {
+	if role != nil && role.AnnotationPattern != "" {
+		return role.AnnotationPattern
+	}
+	return config.annotationPattern()
+}
+
+// annotationPattern returns the pattern which every value a service account interpolates into
+// the statements of a concrete role must match
+func annotationPattern(role *roleEntry, config *kubeConfig) (*regexp.Regexp, error) {
+	return compileAnnotationPattern(rolePattern(role, config))
+}
+
+// compileAnnotationPattern validates an annotation_pattern and compiles it anchored at both
+// ends, so a value must match it in full: `[\w.]+` does not allow "a;b" through the "a".
+// The pattern is compiled on its own first, as wrapping could otherwise balance a pattern
+// like `a)|(b` into one which matches far more than intended.
+func compileAnnotationPattern(pattern string) (*regexp.Regexp, error) {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return nil, err
+	}
+	return regexp.Compile(`^(?:` + pattern + `)$`)
+}
+
+// checkAnnotationPattern returns an error if a service account has values which may not be
+// interpolated into the statements of a concrete role
+func checkAnnotationPattern(k8sName *k8sRoleName, role *roleEntry, config *kubeConfig, mapping *saCacheObject) error {
+	pattern, err := annotationPattern(role, config)
+	if err != nil {
+		return err
+	}
+
+	if rejected := mapping.rejectedValues(pattern); len(rejected) > 0 {
+		return fmt.Errorf("service account %s/%s has values %q which do not match annotation_pattern %s of role %q",
+			k8sName.Namespace, k8sName.ServiceAccount, rejected, rolePattern(role, config), k8sName.Role)
+	}
+	return nil
+}
+
+// getObjectAnnotations pulls the configured annotation keys out of a k8s object. Values for
+// the configured template variables are read from annotations and labels in the same way.
+// Values are not checked against an annotation_pattern here, as the pattern depends on the
+// concrete role they are applied to. The returned object has an empty keyspace if the object
+// is not annotated.
+func (b *databaseBackend) getObjectAnnotations(config *kubeConfig, obj interface{}) (*saCacheObject, error) {
+	return b.getObjectMapping(config, obj, nil)
+}
 
-var nameRegex = regexp.MustCompile(nameRegexStr)
+// getObjectMapping is getObjectAnnotations, where the keyspace and db_name annotations of
+// namespace, if given, are used when the object has none
+func (b *databaseBackend) getObjectMapping(config *kubeConfig, obj interface{}, namespace interface{}) (*saCacheObject, error) {
+	var namespaceAnnotations map[string]string
+	if namespace != nil {
+		namespaceMeta, err := meta.Accessor(namespace)
+		if err != nil {
+			return nil, err
+		}
+		namespaceAnnotations = namespaceMeta.GetAnnotations()
+	}
 
-// getObjectAnnotations pulls the configured annotation key out of a k8s object,
-// checking it against a fairly restrictive regex to avoid injection
-func (b *databaseBackend) getObjectAnnotations(keyspaceKey, dbNameKey string, obj interface{}) (string, string, error) {
 	meta, err := meta.Accessor(obj)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
 	annotations := meta.GetAnnotations()
 
-	if annotations == nil {
-		return "", "", nil
+	keyspaceValue, keyspaceLevel := annotationWithDefault(config.KeyspaceAnnotation, annotations, namespaceAnnotations)
+	if keyspaceValue == "" {
+		return &saCacheObject{}, nil
+	}
+
+	keyspaces, err := parseKeyspaceAnnotation(keyspaceValue)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keyspaces) == 0 {
+		return &saCacheObject{}, nil
+	}
+
+	dbName, dbNameLevel := annotationWithDefault(config.DBNameAnnotation, annotations, namespaceAnnotations)
+
+	result := &saCacheObject{
+		Keyspace:      keyspaces[0],
+		DBName:        dbName,
+		KeyspaceLevel: keyspaceLevel,
+		DBNameLevel:   dbNameLevel,
+	}
+	if len(keyspaces) > 1 {
+		result.Keyspaces = keyspaces
 	}
 
-	keyspace := annotations[keyspaceKey]
+	result.Annotations = templateVariableValues(config.AnnotationVariables, annotations)
+	result.Labels = templateVariableValues(config.LabelVariables, meta.GetLabels())
+
+	return result, nil
+}
 
-	if len(keyspace) == 0 {
-		return "", "", nil
+// parseKeyspaceAnnotation splits a keyspace annotation into its values. The annotation may
+// hold a single value, a comma separated list or a JSON array of strings.
+func parseKeyspaceAnnotation(value string) ([]string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
 	}
 
-	if !nameRegex.MatchString(keyspace) {
-		return "", "", errors.New(fmt.Sprintf("annotation %s did not match regex %s", keyspace, nameRegexStr))
+	var values []string
+	if strings.HasPrefix(value, "[") {
+		if err := json.Unmarshal([]byte(value), &values); err != nil {
+			return nil, fmt.Errorf("annotation %s is not a valid JSON array: %v", value, err)
+		}
+	} else {
+		values = strings.Split(value, ",")
 	}
 
-	dbName := annotations[dbNameKey]
+	var keyspaces []string
+	seen := map[string]struct{}{}
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if _, ok := seen[v]; ok {
+			continue
+		}
+		seen[v] = struct{}{}
+		keyspaces = append(keyspaces, v)
+	}
 
-	return keyspace, dbName, nil
+	return keyspaces, nil
 }
 
-// getServiceAccountAnnotations tries two strategies to find the annotation values for a service account.
+// templateVariableValues maps template variable names to the values of the object's annotations
+// or labels they are configured to read. Variables whose key is not set on the object are omitted.
+func templateVariableValues(variables map[string]string, values map[string]string) map[string]string {
+	var result map[string]string
+
+	for variable, key := range variables {
+		value, ok := values[key]
+		if !ok || value == "" {
+			continue
+		}
+
+		if result == nil {
+			result = map[string]string{}
+		}
+		result[variable] = value
+	}
+
+	return result
+}
+
+// templateVariables returns the values to interpolate into the statements of a virtual role
+func templateVariables(k8sName *k8sRoleName, mapping *saCacheObject) map[string]string {
+	variables := map[string]string{
+		"annotation":      mapping.Keyspace,
+		"namespace":       k8sName.Namespace,
+		"service_account": k8sName.ServiceAccount,
+		"concrete_role":   k8sName.Role,
+	}
+
+	for name, value := range mapping.Annotations {
+		variables["annotations."+name] = value
+	}
+
+	for name, value := range mapping.Labels {
+		variables["labels."+name] = value
+	}
+
+	return variables
+}
+
+// expandStatements interpolates the template variables of a service account into statements.
+// Statements referring to {{annotation}} are repeated once for each keyspace of the service account.
+func expandStatements(statements []string, k8sName *k8sRoleName, mapping *saCacheObject) ([]string, error) {
+	variables := templateVariables(k8sName, mapping)
+
+	var expanded []string
+	for _, statement := range statements {
+		if !strings.Contains(statement, "{{annotation}}") {
+			transformed, err := interpolateStatement(statement, variables)
+			if err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, transformed)
+			continue
+		}
+
+		for _, keyspace := range mapping.keyspaces() {
+			variables["annotation"] = keyspace
+			transformed, err := interpolateStatement(statement, variables)
+			if err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, transformed)
+		}
+	}
+
+	return expanded, nil
+}
+
+// interpolateStatement replaces template variables in a statement, failing if it refers to an
+// annotation or label variable which the service account does not have
+func interpolateStatement(statement string, variables map[string]string) (string, error) {
+	statement = dbutil.QueryHelper(statement, variables)
+
+	for _, prefix := range []string{"{{annotations.", "{{labels."} {
+		if i := strings.Index(statement, prefix); i != -1 {
+			variable := statement[i:]
+			if end := strings.Index(variable, "}}"); end != -1 {
+				variable = variable[:end+2]
+			}
+			return "", fmt.Errorf("service account has no value for template variable %s", variable)
+		}
+	}
+
+	return statement, nil
+}
+
+// Sources of a service account mapping, as reported by lookupServiceAccount
+const (
+	mappingSourceCache   = "cache"
+	mappingSourceStorage = "storage"
+)
+
+// getServiceAccountAnnotations returns the mapping of a service account which virtual roles
+// are resolved from. A nil mapping means the service account is unknown, which includes a
+// tombstoned mapping: it is kept to be reported, not to issue credentials.
+func (b *databaseBackend) getServiceAccountAnnotations(ctx context.Context, s logical.Storage, cluster, namespace, svcAccountName string) (*saCacheObject, error) {
+	mapping, _, err := b.lookupServiceAccount(ctx, s, cluster, namespace, svcAccountName)
+	if err != nil || mapping == nil || mapping.DeletedAt != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
+
+// lookupServiceAccount tries two strategies to find the annotation values for a service account.
 // First it tries to read the service account out of the reflector cache. However this may not be populated
 // if the plugin just started. If not found there, it reads Vault storage in case the plugin has ever synced
-// this service account before and stored it persistently.
-func (b *databaseBackend) getServiceAccountAnnotations(ctx context.Context, s logical.Storage, namespace, svcAccountName string) (string, string, error) {
-	// first try from the cache
-	sa, exists, err := b.saCache.GetByKey(path.Join(namespace, svcAccountName))
+// this service account before and stored it persistently. It also returns which of the two the mapping
+// came from. A nil mapping means the service account is unknown.
+func (b *databaseBackend) lookupServiceAccount(ctx context.Context, s logical.Storage, cluster, namespace, svcAccountName string) (*saCacheObject, string, error) {
+	config, err := b.kubeconfig(ctx, s, cluster)
 	if err != nil {
-		return "", "", err
+		return nil, "", err
 	}
 
-	if exists {
-		config, err := b.kubeconfig(ctx, s)
+	// first try from the cache
+	if w := b.watcher(cluster); w != nil && config != nil {
+		sa, exists, err := w.cache.GetByKey(path.Join(namespace, svcAccountName))
 		if err != nil {
-			return "", "", err
+			return nil, "", err
 		}
 
-		if config != nil {
-			keyspace, dbName, err := b.getObjectAnnotations(config.KeyspaceAnnotation, config.DBNameAnnotation, sa)
+		if exists {
+			mapping, err := b.getServiceAccountMapping(config, w.namespaces, sa)
 			if err != nil {
-				return "", "", err
+				return nil, "", err
 			}
 
-			return keyspace, dbName, nil
+			return mapping, mappingSourceCache, nil
 		}
 	}
 
 	// now try from durable storage
-	key := path.Join("serviceaccount", namespace, svcAccountName)
+	key := b.mappingStoragePrefix(cluster, config) + path.Join(namespace, svcAccountName)
 	entry, err := s.Get(ctx, key)
 	if err != nil {
-		return "", "", err
+		return nil, "", err
 	}
 
 	if entry == nil {
-		return "", "", nil
+		return nil, "", nil
 	}
 
 	var stored saCacheObject
 
 	if err := entry.DecodeJSON(&stored); err != nil {
-		return "", "", err
+		return nil, "", err
 	}
 
-	return stored.Keyspace, stored.DBName, nil
+	return &stored, mappingSourceStorage, nil
 }
 
+// mappedServiceAccounts returns the keys (namespace/name) of all service accounts with a
+// mapping in either the cache or durable storage
+func (b *databaseBackend) mappedServiceAccounts(ctx context.Context, s logical.Storage, cluster string) ([]string, error) {
+	keys := map[string]struct{}{}
+
+	config, err := b.kubeconfig(ctx, s, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := b.mappingStoragePrefix(cluster, config)
+	stored, err := logical.CollectKeysWithPrefix(ctx, s, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range stored {
+		keys[strings.TrimPrefix(k, prefix)] = struct{}{}
+	}
+
+	if w := b.watcher(cluster); w != nil {
+		if config != nil {
+			for _, sa := range w.cache.List() {
+				mapping, err := b.getServiceAccountMapping(config, w.namespaces, sa)
+				if err != nil || mapping.Keyspace == "" {
+					continue
+				}
+
+				key, err := keyFunc(sa)
+				if err != nil {
+					return nil, err
+				}
+				keys[key] = struct{}{}
+			}
+		}
+	}
+
+	result := make([]string, 0, len(keys))
+	for k := range keys {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+
+	return result, nil
+}
+
+// saCacheObject is the mapping of a service account. Its keyspaces and template variable
+// values are stored as read from kubernetes, without checking them against any
+// annotation_pattern, as the pattern which applies depends on the concrete role. They must
+// not be interpolated into statements until checked with rejectedValues against the pattern
+// of that role, as checkAnnotationPattern does.
 type saCacheObject struct {
-	Keyspace string `json:"keyspace"`
-	DBName   string `json:"db_name"`
+	// Keyspace is the first value of the keyspace annotation, and Keyspaces holds
+	// every value if the annotation has more than one
+	Keyspace  string   `json:"keyspace"`
+	Keyspaces []string `json:"keyspaces,omitempty"`
+	DBName    string   `json:"db_name"`
+	// Annotations and Labels hold the values of the configured template variables
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	// KeyspaceLevel and DBNameLevel are set to mappingLevelNamespace when the value was
+	// read from the annotations of the service account's namespace
+	KeyspaceLevel string `json:"keyspace_level,omitempty"`
+	DBNameLevel   string `json:"db_name_level,omitempty"`
+	// DeletedAt is set on a stored mapping once its service account is no longer seen, and
+	// it is deleted once the tombstone grace period has passed
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// rejectedValues returns the keyspaces and template variable values of a mapping which do not
+// match pattern, and so may not be interpolated into statements
+func (o *saCacheObject) rejectedValues(pattern *regexp.Regexp) []string {
+	var rejected []string
+	for _, keyspace := range o.keyspaces() {
+		if !pattern.MatchString(keyspace) {
+			rejected = append(rejected, keyspace)
+		}
+	}
+
+	for _, values := range []map[string]string{o.Annotations, o.Labels} {
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if !pattern.MatchString(values[name]) {
+				rejected = append(rejected, values[name])
+			}
+		}
+	}
+
+	return rejected
+}
+
+// keyspaces returns every value of the keyspace annotation
+func (o *saCacheObject) keyspaces() []string {
+	if len(o.Keyspaces) > 0 {
+		return o.Keyspaces
+	}
+	if o.Keyspace == "" {
+		return nil
+	}
+	return []string{o.Keyspace}
 }
 
 // syncServiceAccounts lists all known service accounts to obtain a mapping of name to annotation
 // and stores this mapping durably in Vault. This allows us to load it immediately on plugin start.
 // Vault should call this function every minute.
 func (b *databaseBackend) syncServiceAccounts(ctx context.Context, req *logical.Request) error {
-	sas := b.saCache.List()
+	clusters, err := b.clusters(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	for _, cluster := range clusters {
+		if err := b.syncClusterServiceAccounts(ctx, req.Storage, cluster); err != nil {
+			b.logger.Error("error syncing service accounts", "cluster", clusterDisplayName(cluster), "error", err)
+		}
+	}
+
+	return nil
+}
 
-	if len(sas) == 0 {
+// syncClusterServiceAccounts acts on the service account mapping of a single cluster, and
+// reconciles its durable copy when due
+func (b *databaseBackend) syncClusterServiceAccounts(ctx context.Context, s logical.Storage, cluster string) (retErr error) {
+	w := b.watcher(cluster)
+	if w == nil {
 		return nil
 	}
+	defer func() { w.status.recordSync(retErr) }()
 
-	config, err := b.kubeconfig(ctx, req.Storage)
+	config, err := b.kubeconfig(ctx, s, cluster)
 	if err != nil {
 		return err
 	}
 
-	b.logger.Debug(fmt.Sprintf("Syncing %d service accounts", len(sas)))
+	if config == nil {
+		return nil
+	}
+
+	if config.grantsFromResources() {
+		return b.syncDatabaseAccess(ctx, s, cluster, config, w)
+	}
+
+	mappings, err := b.serviceAccountMappings(config, w, w.cache.List())
+	if err != nil {
+		return err
+	}
+
+	// Changes are persisted as they are observed, so the whole mapping is only reconciled
+	// occasionally in case any were missed
+	if w.mirror.reconcileDue() {
+		if err := b.reconcileServiceAccounts(ctx, s, cluster, config, w, mappings, false); err != nil {
+			return err
+		}
+	}
+
+	// Until the initial list completes, a service account missing from the cache may simply
+	// not have been listed yet
+	if !w.status.hasSynced() {
+		return nil
+	}
+
+	// A performance secondary keeping a local mapping leaves provisioned static roles, which
+	// are replicated, to the primary. It does not track the leases it issues, which are local
+	// to it.
+	if !writesReplicatedStorage(b.System()) {
+		return nil
+	}
+
+	if err := b.revokeOrphanedLeases(ctx, s, cluster, config, mappings); err != nil {
+		return err
+	}
+
+	return b.provisionStaticRoles(ctx, s, cluster, config, mappings, false)
+}
+
+// serviceAccountMappings returns the mappings of the annotated service accounts in sas, keyed
+// by namespace/name. Service accounts with invalid annotations are left out, and reported.
+// Those with values which do not match the kubeconfig's annotation_pattern are reported, but
+// kept, as a concrete role may set a pattern they match.
+func (b *databaseBackend) serviceAccountMappings(config *kubeConfig, w *serviceAccountWatcher, sas []interface{}) (map[string]*saCacheObject, error) {
+	pattern, err := annotationPattern(nil, config)
+	if err != nil {
+		return nil, err
+	}
 
-	written := map[string]struct{}{}
+	mappings := map[string]*saCacheObject{}
+	invalid := map[string]struct{}{}
+	rejected := map[string][]string{}
 	for _, sa := range sas {
-		keyspace, dbName, err := b.getObjectAnnotations(config.KeyspaceAnnotation, config.DBNameAnnotation, sa)
+		mapping, err := b.getServiceAccountMapping(config, w.namespaces, sa)
 		if err != nil {
 			b.logger.Error(fmt.Sprintf("error getting annotation for object: %v", err))
+			w.events.invalidAnnotation(sa, err)
+			if key, err := keyFunc(sa); err == nil {
+				invalid[key] = struct{}{}
+			}
 			continue
 		}
 
-		if keyspace == "" {
+		if mapping.Keyspace == "" {
 			continue
 		}
 
-		toStore := saCacheObject{Keyspace: keyspace, DBName: dbName}
-
 		key, err := keyFunc(sa)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		// store in serviceaccount/default/s-ledger
-		entry, err := logical.StorageEntryJSON(path.Join("serviceaccount", key), toStore)
-		if err != nil {
-			return err
+		if values := mapping.rejectedValues(pattern); len(values) > 0 {
+			w.events.invalidAnnotation(sa, fmt.Errorf("values %q do not match annotation_pattern %s", values, config.annotationPattern()))
+			invalid[key] = struct{}{}
+			rejected[key] = values
 		}
 
-		err = req.Storage.Put(ctx, entry)
+		mappings[key] = mapping
+	}
+
+	w.events.retainInvalid(invalid)
+	w.status.recordRejected(rejected)
+
+	return mappings, nil
+}
+
+// reconcileServiceAccounts makes the durable mapping of a cluster match the given mappings,
+// keyed by namespace/name, writing only the service accounts whose mapping has changed.
+// Stored mappings are only removed once the watcher has synced, and unless forced, nothing is
+// removed if more than the configured maximum would be.
+func (b *databaseBackend) reconcileServiceAccounts(ctx context.Context, s logical.Storage, cluster string, config *kubeConfig, w *serviceAccountWatcher, mappings map[string]*saCacheObject, force bool) error {
+	var requests uint64
+	if w.mirror != nil {
+		w.mirror.mtx.Lock()
+		defer w.mirror.mtx.Unlock()
+		requests = w.mirror.reconcileRequests()
+	}
+
+	b.logger.Debug(fmt.Sprintf("Reconciling %d service accounts", len(mappings)), "cluster", clusterDisplayName(cluster))
+
+	prefix := b.mappingStoragePrefix(cluster, config)
+
+	var written int
+	for key, mapping := range mappings {
+		// store in serviceaccount/default/s-ledger
+		changed, err := putServiceAccountMapping(ctx, s, prefix+key, mapping)
 		if err != nil {
 			return err
 		}
+		if changed {
+			written++
+		}
+	}
 
-		written[entry.Key] = struct{}{}
+	// A partially populated cache must not be taken to mean that service accounts were deleted
+	if !w.status.hasSynced() {
+		b.logger.Debug(fmt.Sprintf("wrote %d service accounts to storage; skipping deletions until the watcher has synced", written), "cluster", clusterDisplayName(cluster))
+		return nil
 	}
 
 	// we should also delete any service accounts that no longer have the annotation
-	keys, err := logical.CollectKeysWithPrefix(ctx, req.Storage, "serviceaccount/")
+	keys, err := logical.CollectKeysWithPrefix(ctx, s, prefix)
 	if err != nil {
 		return err
 	}
 
-	var deleted int
+	var stale []string
 	for _, k := range keys {
-		if _, ok := written[k]; !ok {
-			if err := req.Storage.Delete(ctx, k); err != nil {
-				return err
-			}
+		if _, ok := mappings[strings.TrimPrefix(k, prefix)]; !ok {
+			stale = append(stale, k)
+		}
+	}
+
+	if maxDeletions := config.maxDeletionsPerSync(); !force && maxDeletions > 0 && len(stale) > maxDeletions {
+		// Tombstones already created are counted too, so that expiring them cannot bypass the cap
+		return fmt.Errorf("refusing to delete %d stored service account mappings, more than max_deletions_per_sync (%d); check the kubeconfig points at the right cluster, then force a reconcile", len(stale), maxDeletions)
+	}
+
+	var tombstoned, deleted int
+	for _, k := range stale {
+		result, err := removeServiceAccountMapping(ctx, s, k, config.tombstoneGracePeriod())
+		if err != nil {
+			return err
+		}
+		switch result {
+		case tombstoneCreated:
+			tombstoned++
+		case tombstoneDeleted:
 			deleted++
 		}
 	}
 
-	b.logger.Debug(fmt.Sprintf("wrote %d service accounts to storage, deleted %d", len(written), deleted))
+	b.logger.Debug(fmt.Sprintf("wrote %d service accounts to storage, tombstoned %d, deleted %d", written, tombstoned, deleted), "cluster", clusterDisplayName(cluster))
+
+	if w.mirror != nil {
+		w.mirror.reconciled(requests)
+	}
 
 	return nil
 }
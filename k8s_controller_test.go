@@ -0,0 +1,2718 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/database/dbplugin"
+	"github.com/hashicorp/vault/sdk/database/helper/dbutil"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	authorizationv1client "k8s.io/client-go/kubernetes/typed/authorization/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestParseKubernetesRoleName(t *testing.T) {
+	testCases := map[string]struct {
+		name     string
+		expected *k8sRoleName
+		err      bool
+	}{
+		"default cluster": {
+			name:     "k8s_rw_s-ledger_default",
+			expected: &k8sRoleName{Role: "rw", ServiceAccount: "s-ledger", Namespace: "default"},
+		},
+		"named cluster": {
+			name:     "k8s-prod_rw_s-ledger_default",
+			expected: &k8sRoleName{Cluster: "prod", Role: "rw", ServiceAccount: "s-ledger", Namespace: "default"},
+		},
+		"role containing underscores": {
+			name:     "k8s_read_only_s-ledger_default",
+			expected: &k8sRoleName{Role: "read_only", ServiceAccount: "s-ledger", Namespace: "default"},
+		},
+		"too few components": {
+			name: "k8s_rw_s-ledger",
+			err:  true,
+		},
+		"empty cluster": {
+			name: "k8s-_rw_s-ledger_default",
+			err:  true,
+		},
+		"unknown prefix": {
+			name: "k8sprod_rw_s-ledger_default",
+			err:  true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			actual, err := parseKubernetesRoleName(tc.name)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := deep.Equal(tc.expected, actual); diff != nil {
+				t.Fatal(diff)
+			}
+			if actual.String() != tc.name {
+				t.Fatalf("expected %q to format as itself, got %q", tc.name, actual.String())
+			}
+		})
+	}
+}
+
+func TestBackend_getServiceAccountAnnotations_clusters(t *testing.T) {
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+
+	ctx := context.Background()
+	mappings := map[string]saCacheObject{
+		"serviceaccount/default/s-ledger":              {Keyspace: "ledger"},
+		"cluster/prod/serviceaccount/default/s-ledger": {Keyspace: "ledger_prod", DBName: "prod"},
+	}
+	for key, value := range mappings {
+		entry, err := logical.StorageEntryJSON(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := config.StorageView.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for cluster, expected := range map[string]saCacheObject{
+		"":        {Keyspace: "ledger"},
+		"prod":    {Keyspace: "ledger_prod", DBName: "prod"},
+		"staging": {},
+	} {
+		mapping, err := b.getServiceAccountAnnotations(ctx, config.StorageView, cluster, "default", "s-ledger")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mapping == nil {
+			mapping = &saCacheObject{}
+		}
+		if diff := deep.Equal(expected, *mapping); diff != nil {
+			t.Fatalf("cluster %q: %v", cluster, diff)
+		}
+	}
+}
+
+func TestKubeConfig_credentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenPath := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenPath, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &kubeConfig{Host: "https://127.0.0.1", CACert: "ca", TokenPath: tokenPath}
+	if !config.reloadsCredentials() {
+		t.Fatal("expected credentials to be reloaded")
+	}
+
+	creds, err := config.credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(&kubeCredentials{Host: "https://127.0.0.1", Token: "first", CACert: "ca"}, creds); diff != nil {
+		t.Fatal(diff)
+	}
+
+	if err := ioutil.WriteFile(tokenPath, []byte("second"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	creds, err = config.credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.Token != "second" {
+		t.Fatalf("expected rotated token to be read, got %q", creds.Token)
+	}
+
+	config.TokenPath = filepath.Join(dir, "missing")
+	if _, err := config.credentials(); err == nil {
+		t.Fatal("expected error reading missing token file")
+	}
+}
+
+// newTestWatcher registers a watcher for the cluster which is fed from a fake
+// ListerWatcher rather than a Kubernetes API server
+func newTestWatcher(t *testing.T, b *databaseBackend, cluster string, sas ...v1.ServiceAccount) (*serviceAccountWatcher, *watch.FakeWatcher) {
+	t.Helper()
+
+	w := &serviceAccountWatcher{
+		cache:  cache.NewStore(keyFunc),
+		logger: b.logger,
+		stopCh: make(chan struct{}),
+	}
+
+	return runTestWatcher(t, b, cluster, w, sas...)
+}
+
+// runTestWatcher starts the reflector of a watcher from a fake ListerWatcher and registers it
+func runTestWatcher(t *testing.T, b *databaseBackend, cluster string, w *serviceAccountWatcher, sas ...v1.ServiceAccount) (*serviceAccountWatcher, *watch.FakeWatcher) {
+	t.Helper()
+
+	fakeWatch := watch.NewFake()
+	w.runReflectors(map[string]cache.ListerWatcher{metav1.NamespaceAll: &cache.ListWatch{
+		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+			return &v1.ServiceAccountList{ListMeta: metav1.ListMeta{ResourceVersion: "1"}, Items: sas}, nil
+		},
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+			return fakeWatch, nil
+		},
+	}}, nil, nil, time.Hour)
+
+	b.watchMtx.Lock()
+	b.watchers[cluster] = w
+	b.watchMtx.Unlock()
+
+	waitFor(t, w.status.hasSynced)
+
+	return w, fakeWatch
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	waitForTimeout(t, time.Second, condition)
+}
+
+func waitForTimeout(t *testing.T, timeout time.Duration, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for condition")
+}
+
+func newIntPtr(i int) *int {
+	return &i
+}
+
+func newDurationPtr(d time.Duration) *time.Duration {
+	return &d
+}
+
+func testServiceAccount(namespace, name string, annotations map[string]string) v1.ServiceAccount {
+	return v1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       namespace,
+			Name:            name,
+			Annotations:     annotations,
+			ResourceVersion: "1",
+		},
+	}
+}
+
+func TestBackend_kubeconfigStatus(t *testing.T) {
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	entry, err := logical.StorageEntryJSON(kubeconfigPath, &kubeConfig{KeyspaceAnnotation: "monzo.com/keyspace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StorageView.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+
+	w, fakeWatch := newTestWatcher(t, b, "", testServiceAccount("default", "s-ledger", map[string]string{"monzo.com/keyspace": "ledger"}))
+
+	second := testServiceAccount("default", "s-account", nil)
+	second.ResourceVersion = "2"
+	fakeWatch.Add(&second)
+	waitFor(t, func() bool { return w.lastSyncResourceVersions()[metav1.NamespaceAll] == "2" })
+
+	if err := b.syncServiceAccounts(context.Background(), &logical.Request{Storage: config.StorageView}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "kubeconfig/status",
+		Storage:   config.StorageView,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	if !resp.Data["synced"].(bool) {
+		t.Fatal("expected watcher to be synced")
+	}
+	if resp.Data["object_count"].(int) != 2 {
+		t.Fatalf("expected 2 objects, got %v", resp.Data["object_count"])
+	}
+	if resp.Data["last_resource_version"].(string) != "2" {
+		t.Fatalf("expected resource version 2, got %v", resp.Data["last_resource_version"])
+	}
+	if resp.Data["last_sync_time"].(string) == "" || resp.Data["last_sync_error"].(string) != "" {
+		t.Fatalf("expected a successful sync, got %#v", resp.Data)
+	}
+	if resp.Data["last_event_time"].(string) == "" || resp.Data["last_relist_time"].(string) == "" {
+		t.Fatalf("expected both a watch event and a relist, got %#v", resp.Data)
+	}
+	if resp.Data["last_success_time"].(string) == "" || resp.Data["last_error"].(string) != "" {
+		t.Fatalf("expected successful API calls, got %#v", resp.Data)
+	}
+
+	// a relist is not a watch event
+	w.status.Lock()
+	w.status.lastEvent = time.Time{}
+	w.status.Unlock()
+	w.status.recordReplace(metav1.NamespaceAll)
+	if data := w.statusData(); data["last_event_time"] != "" {
+		t.Fatalf("expected a relist not to count as a watch event, got %v", data["last_event_time"])
+	}
+
+	// an error is kept after a later success, which shows it is no longer current
+	w.status.recordCall(errors.New("connection refused"))
+	data := w.statusData()
+	if data["last_error"] != "connection refused" || data["last_error_time"].(string) < data["last_success_time"].(string) {
+		t.Fatalf("expected a current error, got %#v", data)
+	}
+	w.status.Lock()
+	w.status.lastErrorTime = w.status.lastErrorTime.Add(-time.Minute)
+	w.status.Unlock()
+	w.status.recordCall(nil)
+	data = w.statusData()
+	if data["last_error"] != "connection refused" || data["last_error_time"].(string) >= data["last_success_time"].(string) {
+		t.Fatalf("expected the error to precede the last success, got %#v", data)
+	}
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "kubeconfig/prod/status",
+		Storage:   config.StorageView,
+	})
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected error for unconfigured cluster, got err:%s resp:%#v\n", err, resp)
+	}
+}
+
+func TestBackend_serviceAccountsInspection(t *testing.T) {
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	ctx := context.Background()
+	for key, value := range map[string]interface{}{
+		kubeconfigPath:                 &kubeConfig{KeyspaceAnnotation: "monzo.com/keyspace", DBNameAnnotation: "monzo.com/cluster"},
+		"serviceaccount/other/s-stale": saCacheObject{Keyspace: "stale"},
+	} {
+		entry, err := logical.StorageEntryJSON(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := config.StorageView.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newTestWatcher(t, b, "",
+		testServiceAccount("default", "s-ledger", map[string]string{"monzo.com/keyspace": "ledger", "monzo.com/cluster": "cassandra"}),
+		testServiceAccount("default", "s-plain", nil),
+	)
+
+	handle := func(op logical.Operation, path string) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   config.StorageView,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, resp)
+		}
+		return resp
+	}
+
+	resp := handle(logical.ListOperation, "serviceaccounts/")
+	if diff := deep.Equal([]string{"default/", "other/"}, resp.Data["keys"]); diff != nil {
+		t.Fatal(diff)
+	}
+
+	resp = handle(logical.ListOperation, "serviceaccounts/default/")
+	if diff := deep.Equal([]string{"s-ledger"}, resp.Data["keys"]); diff != nil {
+		t.Fatal(diff)
+	}
+
+	resp = handle(logical.ReadOperation, "serviceaccounts/default/s-ledger")
+	expected := map[string]interface{}{"keyspace": "ledger", "keyspaces": []string{"ledger"}, "db_name": "cassandra", "source": mappingSourceCache,
+		"keyspace_level": mappingLevelServiceAccount, "db_name_level": mappingLevelServiceAccount,
+		"annotation_pattern": defaultAnnotationPattern, "rejected_values": []string{}}
+	if diff := deep.Equal(expected, resp.Data); diff != nil {
+		t.Fatal(diff)
+	}
+
+	resp = handle(logical.ReadOperation, "serviceaccounts/other/s-stale")
+	expected = map[string]interface{}{"keyspace": "stale", "keyspaces": []string{"stale"}, "db_name": "", "source": mappingSourceStorage,
+		"keyspace_level": mappingLevelServiceAccount, "db_name_level": mappingLevelServiceAccount,
+		"annotation_pattern": defaultAnnotationPattern, "rejected_values": []string{}}
+	if diff := deep.Equal(expected, resp.Data); diff != nil {
+		t.Fatal(diff)
+	}
+
+	if resp := handle(logical.ReadOperation, "serviceaccounts/other/s-missing"); resp != nil {
+		t.Fatalf("expected no response, got %#v", resp)
+	}
+}
+
+func TestBackend_k8sRoleTemplateVariables(t *testing.T) {
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	ctx := context.Background()
+	kubeconfig := &kubeConfig{
+		KeyspaceAnnotation:  "monzo.com/keyspace",
+		DBNameAnnotation:    "monzo.com/cluster",
+		AnnotationVariables: map[string]string{"team": "monzo.com/team"},
+		LabelVariables:      map[string]string{"app": "app"},
+	}
+	entry, err := logical.StorageEntryJSON(kubeconfigPath, kubeconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StorageView.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	withLabels := testServiceAccount("default", "s-ledger", map[string]string{"monzo.com/keyspace": "ledger", "monzo.com/team": "payments"})
+	withLabels.Labels = map[string]string{"app": "ledger_api"}
+	newTestWatcher(t, b, "", withLabels, testServiceAccount("default", "s-bare", map[string]string{"monzo.com/keyspace": "bare"}))
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "roles/rw",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"db_name":               "plugin-test",
+			"creation_statements":   `GRANT {{concrete_role}} ON "{{annotation}}" TO "{{namespace}}.{{service_account}}" COMMENT '{{annotations.team}} {{labels.app}}';`,
+			"revocation_statements": `REVOKE ALL ON KEYSPACE "{{annotation}}" FROM {{name}};`,
+			"renew_statements":      `ALTER USER {{name}} COMMENT '{{annotation}}';`,
+			"rollback_statements":   `DROP USER {{name}} -- {{service_account}}`,
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	role, err := b.Role(ctx, config.StorageView, "k8s_rw_s-ledger_default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{`GRANT rw ON "ledger" TO "default.s-ledger" COMMENT 'payments ledger_api';`}
+	if diff := deep.Equal(expected, role.Statements.Creation); diff != nil {
+		t.Fatal(diff)
+	}
+	if diff := deep.Equal([]string{`REVOKE ALL ON KEYSPACE "ledger" FROM {{name}};`}, role.Statements.Revocation); diff != nil {
+		t.Fatal(diff)
+	}
+	if diff := deep.Equal([]string{`ALTER USER {{name}} COMMENT 'ledger';`}, role.Statements.Renewal); diff != nil {
+		t.Fatal(diff)
+	}
+	if diff := deep.Equal([]string{`DROP USER {{name}} -- s-ledger`}, role.Statements.Rollback); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// a service account without the annotation or label cannot use the role
+	if _, err := b.Role(ctx, config.StorageView, "k8s_rw_s-bare_default"); err == nil {
+		t.Fatal("expected error for missing template variable")
+	}
+}
+
+func TestParseKeyspaceAnnotation(t *testing.T) {
+	testCases := map[string]struct {
+		value    string
+		expected []string
+		err      bool
+	}{
+		"empty":           {value: "", expected: nil},
+		"single":          {value: "ledger", expected: []string{"ledger"}},
+		"comma separated": {value: "ledger, accounts,,ledger", expected: []string{"ledger", "accounts"}},
+		"json array":      {value: `["ledger", "accounts"]`, expected: []string{"ledger", "accounts"}},
+		"invalid json":    {value: `["ledger"`, err: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			actual, err := parseKeyspaceAnnotation(tc.value)
+			if tc.err != (err != nil) {
+				t.Fatalf("unexpected error state: %v", err)
+			}
+			if diff := deep.Equal(tc.expected, actual); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestExpandStatements(t *testing.T) {
+	k8sName := &k8sRoleName{Role: "rw", ServiceAccount: "s-ledger", Namespace: "default"}
+	mapping := &saCacheObject{Keyspace: "ledger", Keyspaces: []string{"ledger", "accounts"}}
+
+	actual, err := expandStatements([]string{
+		`CREATE USER '{{username}}';`,
+		`GRANT ALL ON KEYSPACE "{{annotation}}" TO {{username}};`,
+	}, k8sName, mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`CREATE USER '{{username}}';`,
+		`GRANT ALL ON KEYSPACE "ledger" TO {{username}};`,
+		`GRANT ALL ON KEYSPACE "accounts" TO {{username}};`,
+	}
+	if diff := deep.Equal(expected, actual); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// invalid values anywhere in the list are rejected
+	config := &kubeConfig{KeyspaceAnnotation: "monzo.com/keyspace"}
+	sa := testServiceAccount("default", "s-ledger", map[string]string{"monzo.com/keyspace": "ledger,bad;value"})
+	mapping, err = (&databaseBackend{}).getObjectAnnotations(config, &sa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkAnnotationPattern(k8sName, &roleEntry{}, config, mapping); err == nil {
+		t.Fatal("expected error for invalid keyspace")
+	}
+}
+
+func TestBackend_provisionStaticRoles_deprovision(t *testing.T) {
+	ctx := context.Background()
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(ctx, config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	put := func(name string, role *roleEntry) {
+		entry, err := logical.StorageEntryJSON(databaseStaticRolePath+name, role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := config.StorageView.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db := testFakeDatabase(t, b, config.StorageView)
+	db.users["s-ledger"] = "password"
+
+	mapping := &saCacheObject{Keyspace: "ledger"}
+	put("app", &roleEntry{DBName: "db", StaticAccount: &staticAccount{Username: "{{service_account}}", KubernetesTemplate: true}})
+	// provisioned from a template which has since been deleted
+	put("k8s_old_s-ledger_default", &roleEntry{DBName: "db", StaticAccount: &staticAccount{Username: "s-ledger", KubernetesMapping: mapping}})
+	// provisioned in another cluster
+	put("k8s-prod_old_s-ledger_default", &roleEntry{DBName: "db", StaticAccount: &staticAccount{Username: "s-ledger", KubernetesMapping: mapping}})
+	// not provisioned, so left alone despite its name
+	put("k8s_manual_s-ledger_default", &roleEntry{DBName: "db", StaticAccount: &staticAccount{Username: "s-ledger"}})
+
+	// no service accounts are annotated, so nothing is provisioned from the template
+	if err := b.provisionStaticRoles(ctx, config.StorageView, "", &kubeConfig{}, map[string]*saCacheObject{}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := config.StorageView.List(ctx, databaseStaticRolePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"app", "k8s-prod_old_s-ledger_default", "k8s_manual_s-ledger_default"}
+	if diff := deep.Equal(expected, names); diff != nil {
+		t.Fatal(diff)
+	}
+	if _, ok := db.users["s-ledger"]; ok {
+		t.Fatal("expected the user of the removed static role to be dropped")
+	}
+
+	// templates have no credentials of their own
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "static-creds/app",
+		Storage:   config.StorageView,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("expected error reading credentials of a template, got %#v", resp)
+	}
+}
+
+func TestBackend_provisionStaticRoles(t *testing.T) {
+	ctx := context.Background()
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(ctx, config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	s := config.StorageView
+	db := testFakeDatabase(t, b, s)
+
+	writeTemplate := func(data map[string]interface{}) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "static-roles/app",
+			Storage:   s,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err: %v resp: %#v", err, resp)
+		}
+	}
+
+	// a static role has a single user, however many keyspaces its service account is granted
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "static-roles/app",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"db_name":             "db",
+			"username":            "{{service_account}}_{{annotation}}",
+			"rotation_period":     3600,
+			"kubernetes_template": true,
+			"creation_statements": []string{`CREATE USER '{{username}}' WITH PASSWORD '{{password}}';`},
+			"rotation_statements": []string{`ALTER USER '{{username}}' WITH PASSWORD '{{password}}';`},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "{{annotation}}") {
+		t.Fatalf("expected template to be rejected, got %#v", resp)
+	}
+
+	writeTemplate(map[string]interface{}{
+		"db_name":             "db",
+		"username":            "{{service_account}}",
+		"rotation_period":     3600,
+		"kubernetes_template": true,
+		"creation_statements": []string{
+			`CREATE USER '{{username}}' WITH PASSWORD '{{password}}';`,
+			`GRANT ALL ON KEYSPACE "{{annotation}}" TO '{{username}}';`,
+		},
+		"rotation_statements":   []string{`ALTER USER '{{username}}' WITH PASSWORD '{{password}}';`},
+		"revocation_statements": []string{`DROP USER '{{username}}';`},
+	})
+
+	readCreds := func(name string) (string, string) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "static-creds/" + name,
+			Storage:   s,
+		})
+		if err != nil || resp == nil || resp.IsError() {
+			t.Fatalf("err: %v resp: %#v", err, resp)
+		}
+		return resp.Data["username"].(string), resp.Data["password"].(string)
+	}
+
+	kubeconfig := &kubeConfig{MaxDeletionsPerSync: newIntPtr(1)}
+	mappings := map[string]*saCacheObject{
+		"default/s-ledger":   {Keyspace: "ledger"},
+		"default/s-accounts": {Keyspace: "accounts"},
+	}
+	if err := b.provisionStaticRoles(ctx, s, "", kubeconfig, mappings, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// the users really exist, with the passwords Vault hands out
+	username, password := readCreds("k8s_app_s-ledger_default")
+	if username != "s-ledger" || db.users["s-ledger"] != password {
+		t.Fatalf("expected user s-ledger with password %q in the database, got %#v", password, db.users)
+	}
+	if _, password := readCreds("k8s_app_s-accounts_default"); db.users["s-accounts"] != password {
+		t.Fatalf("expected user s-accounts with password %q in the database, got %#v", password, db.users)
+	}
+	if db.grants["s-ledger"] != "ledger" || db.grants["s-accounts"] != "accounts" {
+		t.Fatalf("expected keyspaces to be granted, got %#v", db.grants)
+	}
+
+	// nothing changed, so nothing is rotated
+	if err := b.provisionStaticRoles(ctx, s, "", kubeconfig, mappings, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, unchanged := readCreds("k8s_app_s-ledger_default"); unchanged != password {
+		t.Fatal("expected an unchanged static role not to be rotated")
+	}
+
+	// a change to the template re-provisions the role with the new statements
+	writeTemplate(map[string]interface{}{
+		"username":            "{{service_account}}",
+		"rotation_statements": []string{`ALTER USER '{{username}}' WITH PASSWORD '{{password}}'`},
+	})
+	if err := b.provisionStaticRoles(ctx, s, "", kubeconfig, mappings, false); err != nil {
+		t.Fatal(err)
+	}
+	role, err := b.StaticRole(ctx, s, "k8s_app_s-ledger_default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal([]string{`ALTER USER '{{username}}' WITH PASSWORD '{{password}}'`}, role.Statements.Rotation); diff != nil {
+		t.Fatal(diff)
+	}
+	if _, rotated := readCreds("k8s_app_s-ledger_default"); rotated == password || db.users["s-ledger"] != rotated {
+		t.Fatalf("expected the re-provisioned role to be rotated, got %#v", db.users)
+	}
+
+	// removing more roles than max_deletions_per_sync is refused unless forced
+	if err := b.provisionStaticRoles(ctx, s, "", kubeconfig, map[string]*saCacheObject{}, false); err == nil || !strings.Contains(err.Error(), "max_deletions_per_sync") {
+		t.Fatalf("expected the removals to be refused, got %v", err)
+	}
+	if len(db.users) != 2 {
+		t.Fatalf("expected no user to be dropped, got %#v", db.users)
+	}
+
+	if err := b.provisionStaticRoles(ctx, s, "", kubeconfig, map[string]*saCacheObject{}, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.users) != 0 {
+		t.Fatalf("expected the users of removed static roles to be dropped, got %#v", db.users)
+	}
+	names, err := s.List(ctx, databaseStaticRolePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal([]string{"app"}, names); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestBackend_staticRoleTemplates_databaseAccess(t *testing.T) {
+	ctx := context.Background()
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(ctx, config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	entry, err := logical.StorageEntryJSON(kubeconfigStorageKey("prod"), &kubeConfig{GrantSource: grantSourceDatabaseAccess})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StorageView.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "static-roles/app",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"db_name":             "db",
+			"username":            "{{service_account}}",
+			"rotation_period":     3600,
+			"kubernetes_template": true,
+			"creation_statements": []string{`CREATE USER '{{username}}' WITH PASSWORD '{{password}}';`},
+			"rotation_statements": []string{`ALTER USER '{{username}}' WITH PASSWORD '{{password}}';`},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), grantSourceDatabaseAccess) {
+		t.Fatalf("expected template to be rejected, got %#v", resp)
+	}
+}
+
+// fakeDatabase stands in for a Cassandra-like plugin, which runs creation statements through
+// CreateUser but does not implement SetCredentials. It understands CREATE, ALTER and DROP USER,
+// and GRANT ALL ON KEYSPACE, and ignores any other statement.
+type fakeDatabase struct {
+	dbplugin.Database
+
+	// users maps usernames to passwords, and grants usernames to keyspaces
+	users     map[string]string
+	grants    map[string]string
+	passwords int
+}
+
+var fakeStatementRegex = regexp.MustCompile(`^(CREATE|ALTER|DROP) USER '([^']*)'(?: WITH PASSWORD '([^']*)')?;?$|^GRANT ALL ON KEYSPACE "([^"]*)" TO '([^']*)';?$`)
+
+// testFakeDatabase configures the "db" connection of the backend with a fakeDatabase
+func testFakeDatabase(t *testing.T, b *databaseBackend, s logical.Storage) *fakeDatabase {
+	t.Helper()
+
+	entry, err := logical.StorageEntryJSON("config/db", &DatabaseConfig{PluginName: "fake", AllowedRoles: []string{"*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+
+	db := &fakeDatabase{users: map[string]string{}, grants: map[string]string{}}
+	b.Lock()
+	b.connections["db"] = &dbPluginInstance{Database: db, id: "fake", name: "db"}
+	b.Unlock()
+
+	return db
+}
+
+func (f *fakeDatabase) run(statements []string, values map[string]string) error {
+	for _, statement := range statements {
+		m := fakeStatementRegex.FindStringSubmatch(dbutil.QueryHelper(statement, values))
+		switch {
+		case m == nil:
+		case m[4] != "":
+			f.grants[m[5]] = m[4]
+		case m[1] == "CREATE":
+			if _, ok := f.users[m[2]]; ok {
+				return fmt.Errorf("user %s already exists", m[2])
+			}
+			f.users[m[2]] = m[3]
+		case m[1] == "ALTER":
+			if _, ok := f.users[m[2]]; !ok {
+				return fmt.Errorf("user %s does not exist", m[2])
+			}
+			f.users[m[2]] = m[3]
+		case m[1] == "DROP":
+			delete(f.users, m[2])
+			delete(f.grants, m[2])
+		}
+	}
+	return nil
+}
+
+func (f *fakeDatabase) Type() (string, error) {
+	return "fake", nil
+}
+
+func (f *fakeDatabase) CreateUser(ctx context.Context, statements dbplugin.Statements, usernameConfig dbplugin.UsernameConfig, expiration time.Time) (string, string, error) {
+	username := "v-" + usernameConfig.RoleName
+	password, _ := f.GenerateCredentials(ctx)
+	values := map[string]string{"username": username, "password": password}
+
+	if err := f.run(statements.Creation, values); err != nil {
+		f.run(statements.Rollback, values)
+		return "", "", err
+	}
+	return username, password, nil
+}
+
+func (f *fakeDatabase) RevokeUser(ctx context.Context, statements dbplugin.Statements, username string) error {
+	revocation := statements.Revocation
+	if len(revocation) == 0 {
+		revocation = []string{`DROP USER '{{username}}';`}
+	}
+	return f.run(revocation, map[string]string{"username": username})
+}
+
+func (f *fakeDatabase) GenerateCredentials(context.Context) (string, error) {
+	f.passwords++
+	return fmt.Sprintf("password-%d", f.passwords), nil
+}
+
+func (f *fakeDatabase) SetCredentials(context.Context, dbplugin.Statements, dbplugin.StaticUserConfig) (string, string, error) {
+	return "", "", dbutil.Unimplemented()
+}
+
+func (f *fakeDatabase) Close() error {
+	return nil
+}
+
+func TestBackend_revokeOrphanedLeases(t *testing.T) {
+	ctx := context.Background()
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(ctx, config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	s := config.StorageView
+	db := testFakeDatabase(t, b, s)
+	now := time.Now()
+	leases := map[string]*trackedLease{
+		"default/s-ledger/v-ledger":     {Role: "k8s_rw_s-ledger_default", DBName: "db", Username: "v-ledger", Keyspaces: []string{"ledger"}, Expiration: now.Add(time.Hour)},
+		"default/s-gone/v-gone":         {Role: "k8s_rw_s-gone_default", DBName: "db", Username: "v-gone", Keyspaces: []string{"gone"}, Expiration: now.Add(time.Hour)},
+		"default/s-moved/v-moved":       {Role: "k8s_rw_s-moved_default", DBName: "db", Username: "v-moved", Keyspaces: []string{"old"}, Expiration: now.Add(time.Hour)},
+		"default/s-migrated/v-migrated": {Role: "k8s_rw_s-migrated_default", DBName: "db", Username: "v-migrated", Keyspaces: []string{"migrated"}, Expiration: now.Add(time.Hour)},
+		"default/s-old/v-old":           {Role: "k8s_rw_s-old_default", DBName: "db", Username: "v-old", Keyspaces: []string{"old"}, Expiration: now.Add(-2 * time.Hour)},
+	}
+	for key, lease := range leases {
+		if err := putTrackedLease(ctx, s, serviceAccountLeasePath+key, lease); err != nil {
+			t.Fatal(err)
+		}
+		db.users[lease.Username] = "password"
+	}
+
+	kubeconfig := &kubeConfig{RevokeLeases: true, RevocationDryRun: true}
+	mappings := map[string]*saCacheObject{
+		"default/s-ledger":   {Keyspace: "ledger"},
+		"default/s-moved":    {Keyspace: "new"},
+		"default/s-migrated": {Keyspace: "migrated", DBName: "other"},
+	}
+	if err := b.revokeOrphanedLeases(ctx, s, "", kubeconfig, mappings); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(key string) *trackedLease {
+		lease, err := b.trackedLease(ctx, s, serviceAccountLeasePath+key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lease
+	}
+
+	if lease := get("default/s-old/v-old"); lease != nil {
+		t.Fatal("expected expired lease to be forgotten")
+	}
+	if lease := get("default/s-ledger/v-ledger"); !lease.RevokeAfter.IsZero() {
+		t.Fatalf("expected lease of mapped service account to be left alone, got %#v", lease)
+	}
+	for _, key := range []string{"default/s-gone/v-gone", "default/s-moved/v-moved", "default/s-migrated/v-migrated"} {
+		if lease := get(key); lease == nil || lease.RevokeAfter.IsZero() {
+			t.Fatalf("expected %s to be scheduled for revocation, got %#v", key, lease)
+		}
+	}
+	if len(db.users) != 5 {
+		t.Fatalf("expected no user to be revoked in a dry run, got %#v", db.users)
+	}
+
+	// restoring the mapping before the grace period passes cancels the revocation
+	mappings["default/s-gone"] = &saCacheObject{Keyspace: "gone"}
+	if err := b.revokeOrphanedLeases(ctx, s, "", kubeconfig, mappings); err != nil {
+		t.Fatal(err)
+	}
+	if lease := get("default/s-gone/v-gone"); !lease.RevokeAfter.IsZero() {
+		t.Fatalf("expected revocation to be cancelled, got %#v", lease)
+	}
+
+	delete(mappings, "default/s-gone")
+	delete(mappings, "default/s-migrated")
+	kubeconfig = &kubeConfig{RevokeLeases: true}
+	if err := b.revokeOrphanedLeases(ctx, s, "", kubeconfig, mappings); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"default/s-gone/v-gone", "default/s-moved/v-moved", "default/s-migrated/v-migrated"} {
+		if lease := get(key); lease == nil || !lease.Revoked {
+			t.Fatalf("expected %s to be revoked, got %#v", key, lease)
+		}
+	}
+	if diff := deep.Equal(map[string]string{"v-ledger": "password", "v-old": "password"}, db.users); diff != nil {
+		t.Fatal(diff)
+	}
+
+	secret := &logical.Secret{InternalData: map[string]interface{}{
+		"username":              "v-gone",
+		"role":                  "k8s_rw_s-gone_default",
+		"db_name":               "db",
+		"revocation_statements": []interface{}{`DROP USER '{{username}}';`},
+	}}
+
+	// the revoked lease can no longer be renewed
+	if _, err := b.secretCredsRenew()(ctx, &logical.Request{Storage: s, Secret: secret}, nil); err == nil {
+		t.Fatal("expected renewal of a revoked lease to fail")
+	}
+
+	// Vault revoking the lease forgets it without dropping the user again, which would fail
+	db.users["v-gone"] = "recreated"
+	if _, err := b.secretCredsRevoke()(ctx, &logical.Request{Storage: s, Secret: secret}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.users["v-gone"]; !ok || get("default/s-gone/v-gone") != nil {
+		t.Fatal("expected revoked lease to be forgotten without revoking the user again")
+	}
+}
+
+func TestBackend_trackLease_replication(t *testing.T) {
+	ctx := context.Background()
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(ctx, config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	s := config.StorageView
+	db := testFakeDatabase(t, b, s)
+	for key, value := range map[string]interface{}{
+		kubeconfigPath:          &kubeConfig{KeyspaceAnnotation: "monzo.com/keyspace"},
+		databaseRolePath + "rw": &roleEntry{DBName: "db", Statements: dbplugin.Statements{Creation: []string{`CREATE USER '{{username}}' WITH PASSWORD '{{password}}';`}}},
+	} {
+		entry, err := logical.StorageEntryJSON(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newTestWatcher(t, b, "", testServiceAccount("default", "s-ledger", map[string]string{"monzo.com/keyspace": "ledger"}))
+
+	sys := config.System.(*logical.StaticSystemView)
+	defer func() { sys.ReplicationStateVal = 0 }()
+	read := func(state consts.ReplicationState) (*logical.Response, error) {
+		sys.ReplicationStateVal = state
+		// the fake database names users after the role
+		for username := range db.users {
+			delete(db.users, username)
+		}
+		if err := deleteWithPrefix(ctx, s, serviceAccountLeasePath); err != nil {
+			t.Fatal(err)
+		}
+		return b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/k8s_rw_s-ledger_default",
+			Storage:   s,
+		})
+	}
+	tracked := func() int {
+		keys, err := logical.CollectKeysWithPrefix(ctx, s, serviceAccountLeasePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(keys)
+	}
+
+	// the primary tracks the lease
+	if resp, err := read(0); err != nil || resp.IsError() || tracked() != 1 {
+		t.Fatalf("expected a tracked lease, got %#v, %v", resp, err)
+	}
+
+	// a performance standby forwards the request without creating a user
+	if _, err := read(consts.ReplicationPerformanceStandby); err != logical.ErrReadOnly || len(db.users) != 0 {
+		t.Fatalf("expected the request to be forwarded, got %v", err)
+	}
+
+	// a performance secondary issues credentials whose lease is local to it, without tracking
+	if resp, err := read(consts.ReplicationPerformanceSecondary); err != nil || resp.IsError() || len(db.users) != 1 || tracked() != 0 {
+		t.Fatalf("expected untracked credentials, got %#v, %v", resp, err)
+	}
+}
+
+// fakeEvents records the Events created through it
+type fakeEvents struct {
+	corev1client.EventInterface
+	created chan *v1.Event
+}
+
+func (f *fakeEvents) Events(namespace string) corev1client.EventInterface {
+	return f
+}
+
+func (f *fakeEvents) Create(event *v1.Event) (*v1.Event, error) {
+	f.created <- event
+	return event, nil
+}
+
+func TestEventRecorder_invalidAnnotation(t *testing.T) {
+	events := &fakeEvents{created: make(chan *v1.Event, 10)}
+	r := newEventRecorder(log.NewNullLogger())
+	r.setClient(events)
+
+	sa := testServiceAccount("default", "s-ledger", map[string]string{"monzo.com/keyspace": "ledger;"})
+	sa.UID = "1234"
+
+	expectEvent := func() {
+		t.Helper()
+		select {
+		case event := <-events.created:
+			if event.Reason != eventReasonInvalidAnnotation || event.Type != v1.EventTypeWarning {
+				t.Fatalf("unexpected event %#v", event)
+			}
+			expected := v1.ObjectReference{Kind: "ServiceAccount", APIVersion: "v1", Namespace: "default", Name: "s-ledger", UID: "1234"}
+			if diff := deep.Equal(expected, event.InvolvedObject); diff != nil {
+				t.Fatal(diff)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected an event")
+		}
+	}
+	expectNoEvent := func() {
+		t.Helper()
+		select {
+		case event := <-events.created:
+			t.Fatalf("unexpected event %#v", event)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	r.invalidAnnotation(&sa, errors.New("annotation ledger; did not match regex"))
+	expectEvent()
+
+	// the same error is only recorded once
+	r.invalidAnnotation(&sa, errors.New("annotation ledger; did not match regex"))
+	expectNoEvent()
+
+	// once the service account is fixed, a recurrence is recorded again
+	r.retainInvalid(map[string]struct{}{})
+	r.invalidAnnotation(&sa, errors.New("annotation ledger; did not match regex"))
+	expectEvent()
+
+	// a nil recorder records nothing
+	var disabled *eventRecorder
+	disabled.invalidAnnotation(&sa, errors.New("annotation ledger; did not match regex"))
+	disabled.record("default", "s-ledger", "", v1.EventTypeNormal, eventReasonCredentialsIssued, "issued")
+}
+
+func TestBackend_allowedDBNameOverrides(t *testing.T) {
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	ctx := context.Background()
+	kubeconfig := &kubeConfig{
+		KeyspaceAnnotation: "monzo.com/keyspace",
+		DBNameAnnotation:   "monzo.com/cluster",
+	}
+	entry, err := logical.StorageEntryJSON(kubeconfigPath, kubeconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StorageView.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	newTestWatcher(t, b, "",
+		testServiceAccount("default", "s-staging", map[string]string{"monzo.com/keyspace": "ledger", "monzo.com/cluster": "staging-1"}),
+		testServiceAccount("default", "s-prod", map[string]string{"monzo.com/keyspace": "ledger", "monzo.com/cluster": "prod"}),
+		testServiceAccount("default", "s-default", map[string]string{"monzo.com/keyspace": "ledger"}),
+	)
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "roles/rw",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"db_name":                   "plugin-test",
+			"creation_statements":       `GRANT ALL ON "{{annotation}}" TO {{name}};`,
+			"allowed_db_name_overrides": "staging-*,dev",
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "roles/rw",
+		Storage:   config.StorageView,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+	if diff := deep.Equal([]string{"staging-*", "dev"}, resp.Data["allowed_db_name_overrides"]); diff != nil {
+		t.Fatal(diff)
+	}
+
+	for name, expected := range map[string]string{
+		"k8s_rw_s-staging_default": "staging-1",
+		"k8s_rw_s-default_default": "plugin-test",
+	} {
+		role, err := b.Role(ctx, config.StorageView, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if role.DBName != expected {
+			t.Fatalf("expected %s to use database %s, got %s", name, expected, role.DBName)
+		}
+	}
+
+	if _, err := b.Role(ctx, config.StorageView, "k8s_rw_s-prod_default"); err == nil {
+		t.Fatal("expected error for a database override outside allowed_db_name_overrides")
+	}
+}
+
+func TestBackend_kubernetesRolePaths(t *testing.T) {
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	ctx := context.Background()
+	entry, err := logical.StorageEntryJSON(kubeconfigPath, &kubeConfig{KeyspaceAnnotation: "monzo.com/keyspace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StorageView.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	newTestWatcher(t, b, "", testServiceAccount("default", "s-ledger", map[string]string{"monzo.com/keyspace": "ledger"}))
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "roles/read_only",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"db_name":             "plugin-test",
+			"creation_statements": `GRANT SELECT ON "{{annotation}}" TO {{name}};`,
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "k8s-roles/read_only/default/s-ledger",
+		Storage:   config.StorageView,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+	if resp.Data["name"] != "k8s_read_only_s-ledger_default" {
+		t.Fatalf("unexpected name %v", resp.Data["name"])
+	}
+	if diff := deep.Equal([]string{`GRANT SELECT ON "ledger" TO {{name}};`}, resp.Data["creation_statements"]); diff != nil {
+		t.Fatal(diff)
+	}
+	if diff := deep.Equal([]string{"ledger"}, resp.Data["keyspaces"]); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// an unannotated service account resolves to nothing
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "k8s-roles/read_only/default/s-missing",
+		Storage:   config.StorageView,
+	})
+	if err != nil || resp != nil {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	// a named cluster is a path segment, and can't be chosen with a parameter
+	entry, err = logical.StorageEntryJSON(kubeconfigStorageKey("prod"), &kubeConfig{KeyspaceAnnotation: "monzo.com/keyspace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StorageView.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+	newTestWatcher(t, b, "prod", testServiceAccount("default", "s-ledger", map[string]string{"monzo.com/keyspace": "payments"}))
+
+	for path, name := range map[string]string{
+		"k8s-roles/read_only/default/s-ledger":      "k8s_read_only_s-ledger_default",
+		"k8s-roles/prod/read_only/default/s-ledger": "k8s-prod_read_only_s-ledger_default",
+	} {
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      path,
+			Storage:   config.StorageView,
+			Data:      map[string]interface{}{"cluster": "staging"},
+		})
+		if err != nil || resp == nil || resp.IsError() {
+			t.Fatalf("err:%s resp:%#v\n", err, resp)
+		}
+		if resp.Data["name"] != name {
+			t.Fatalf("expected %s to resolve %s, got %v", path, name, resp.Data["name"])
+		}
+	}
+}
+
+func TestSecretKubernetesRoleName(t *testing.T) {
+	structured := secretKubernetesRoleName(map[string]interface{}{
+		"role":                "k8s-prod_read_only_s-ledger_default",
+		"k8s_cluster":         "prod",
+		"k8s_role":            "read_only",
+		"k8s_namespace":       "default",
+		"k8s_service_account": "s-ledger",
+	})
+	expected := &k8sRoleName{Cluster: "prod", Role: "read_only", Namespace: "default", ServiceAccount: "s-ledger"}
+	if diff := deep.Equal(expected, structured); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// leases issued before the components were recorded fall back to parsing the name
+	legacy := secretKubernetesRoleName(map[string]interface{}{"role": "k8s-prod_read_only_s-ledger_default"})
+	if diff := deep.Equal(expected, legacy); diff != nil {
+		t.Fatal(diff)
+	}
+
+	if concrete := secretKubernetesRoleName(map[string]interface{}{"role": "rw"}); concrete != nil {
+		t.Fatalf("expected no virtual role, got %#v", concrete)
+	}
+}
+
+func TestBackend_bindServiceAccount(t *testing.T) {
+	sys := logical.TestSystemView()
+	config := logical.TestBackendConfig()
+	config.System = sys
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	ctx := context.Background()
+	entry, err := logical.StorageEntryJSON(kubeconfigPath, &kubeConfig{KeyspaceAnnotation: "monzo.com/keyspace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StorageView.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	newTestWatcher(t, b, "", testServiceAccount("default", "s-ledger", map[string]string{"monzo.com/keyspace": "ledger"}))
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "roles/rw",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"db_name":              "plugin-test",
+			"creation_statements":  `GRANT ALL ON "{{annotation}}" TO {{name}};`,
+			"bind_service_account": true,
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	loginAs := func(mountType, namespace, name string) {
+		sys.EntityVal = &logical.Entity{
+			ID: "entity",
+			Aliases: []*logical.Alias{{
+				MountType:     mountType,
+				MountAccessor: "auth_kubernetes_1234",
+				Name:          "uid",
+				Metadata: map[string]string{
+					"service_account_namespace": namespace,
+					"service_account_name":      name,
+				},
+			}},
+		}
+	}
+
+	read := func(path string) error {
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      path,
+			Storage:   config.StorageView,
+			EntityID:  "entity",
+		})
+		return err
+	}
+
+	for name, login := range map[string]func(){
+		"other service account": func() { loginAs("kubernetes", "default", "s-other") },
+		"other namespace":       func() { loginAs("kubernetes", "other", "s-ledger") },
+		"other auth method":     func() { loginAs("userpass", "default", "s-ledger") },
+	} {
+		login()
+		for _, path := range []string{"creds/k8s_rw_s-ledger_default", "k8s-creds/rw/default/s-ledger"} {
+			if err := read(path); err != logical.ErrPermissionDenied {
+				t.Fatalf("%s: expected permission denied reading %s, got %v", name, path, err)
+			}
+		}
+	}
+
+	// the matching service account gets as far as looking up the database connection
+	loginAs("kubernetes", "default", "s-ledger")
+	if err := read("creds/k8s_rw_s-ledger_default"); err == nil || err == logical.ErrPermissionDenied {
+		t.Fatalf("expected a missing connection error, got %v", err)
+	}
+}
+
+func TestBackend_kubernetesSelfCreds(t *testing.T) {
+	sys := logical.TestSystemView()
+	config := logical.TestBackendConfig()
+	config.System = sys
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	ctx := context.Background()
+	entry, err := logical.StorageEntryJSON(kubeconfigPath, &kubeConfig{KeyspaceAnnotation: "monzo.com/keyspace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StorageView.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	newTestWatcher(t, b, "", testServiceAccount("default", "s-ledger", map[string]string{"monzo.com/keyspace": "ledger"}))
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "roles/rw",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"db_name":             "plugin-test",
+			"creation_statements": `GRANT ALL ON "{{annotation}}" TO {{name}};`,
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	alias := func(accessor, namespace, name string) *logical.Alias {
+		return &logical.Alias{
+			MountType:     "kubernetes",
+			MountAccessor: accessor,
+			Metadata: map[string]string{
+				"service_account_namespace": namespace,
+				"service_account_name":      name,
+			},
+		}
+	}
+
+	readPath := func(path, entityID string) (*logical.Response, error) {
+		return b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      path,
+			Storage:   config.StorageView,
+			EntityID:  entityID,
+		})
+	}
+	read := func(entityID string) (*logical.Response, error) {
+		return readPath("k8s-self-creds/rw", entityID)
+	}
+
+	// a token without an entity has no service account
+	if resp, err := read(""); err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected error response, got err:%v resp:%#v", err, resp)
+	}
+
+	sys.EntityVal = &logical.Entity{ID: "entity", Aliases: []*logical.Alias{alias("auth_kubernetes_1", "default", "s-bare")}}
+	if resp, err := read("entity"); err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected error response for an unannotated service account, got err:%v resp:%#v", err, resp)
+	}
+
+	sys.EntityVal = &logical.Entity{ID: "entity", Aliases: []*logical.Alias{alias("auth_kubernetes_1", "default", "s-ledger"), alias("auth_kubernetes_2", "default", "s-bare")}}
+	if resp, err := read("entity"); err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected error response for ambiguous aliases, got err:%v resp:%#v", err, resp)
+	}
+
+	// naming the auth mount resolves the ambiguity, and the caller's service account gets as
+	// far as looking up the database connection
+	entry, err = logical.StorageEntryJSON(kubeconfigPath, &kubeConfig{KeyspaceAnnotation: "monzo.com/keyspace", AuthMountAccessor: "auth_kubernetes_1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StorageView.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := read("entity"); err == nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("expected a missing connection error, got err:%v resp:%#v", err, resp)
+	}
+
+	// a named cluster must name its auth mount, or a client of another cluster could take the
+	// service account of the same name
+	prod := &kubeConfig{KeyspaceAnnotation: "monzo.com/keyspace"}
+	putProd := func() {
+		entry, err := logical.StorageEntryJSON(kubeconfigStorageKey("prod"), prod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := config.StorageView.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	putProd()
+	newTestWatcher(t, b, "prod", testServiceAccount("default", "s-ledger", map[string]string{"monzo.com/keyspace": "ledger"}))
+	sys.EntityVal = &logical.Entity{ID: "entity", Aliases: []*logical.Alias{alias("auth_kubernetes_1", "default", "s-ledger")}}
+	if resp, err := readPath("k8s-self-creds/prod/rw", "entity"); err != nil || resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "auth_mount_accessor") {
+		t.Fatalf("expected an error response without auth_mount_accessor, got err:%v resp:%#v", err, resp)
+	}
+
+	// and only aliases of that mount are accepted
+	prod.AuthMountAccessor = "auth_kubernetes_2"
+	putProd()
+	if resp, err := readPath("k8s-self-creds/prod/rw", "entity"); err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected an error response for an alias of another mount, got err:%v resp:%#v", err, resp)
+	}
+	sys.EntityVal = &logical.Entity{ID: "entity", Aliases: []*logical.Alias{alias("auth_kubernetes_2", "default", "s-ledger")}}
+	if resp, err := readPath("k8s-self-creds/prod/rw", "entity"); err == nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("expected a missing connection error, got err:%v resp:%#v", err, resp)
+	}
+
+	// once another cluster is configured, the default cluster must name its auth mount too
+	entry, err = logical.StorageEntryJSON(kubeconfigPath, &kubeConfig{KeyspaceAnnotation: "monzo.com/keyspace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StorageView.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := read("entity"); err != nil || resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "auth_mount_accessor") {
+		t.Fatalf("expected an error response without auth_mount_accessor, got err:%v resp:%#v", err, resp)
+	}
+}
+
+// countingStorage counts the writes made to storage
+type countingStorage struct {
+	logical.Storage
+	mtx  sync.Mutex
+	puts int
+}
+
+func (s *countingStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	s.mtx.Lock()
+	s.puts++
+	s.mtx.Unlock()
+	return s.Storage.Put(ctx, entry)
+}
+
+func (s *countingStorage) putCount() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.puts
+}
+
+func TestBackend_serviceAccountMirror(t *testing.T) {
+	config := logical.TestBackendConfig()
+	storage := &countingStorage{Storage: &logical.InmemStorage{}}
+	config.StorageView = storage
+	b := Backend(config)
+	if err := b.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	ctx := context.Background()
+	kubeconfig := &kubeConfig{KeyspaceAnnotation: "monzo.com/keyspace", DBNameAnnotation: "monzo.com/cluster", TombstoneGracePeriod: newDurationPtr(0)}
+	entry, err := logical.StorageEntryJSON(kubeconfigPath, kubeconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &serviceAccountWatcher{
+		cache:  cache.NewStore(keyFunc),
+		logger: b.logger,
+		stopCh: make(chan struct{}),
+	}
+	w.mirror = newServiceAccountMirror(b, storage, "", kubeconfig, w.cache)
+	go w.mirror.run(w.stopCh)
+	_, fakeWatch := runTestWatcher(t, b, "", w, testServiceAccount("default", "s-ledger", map[string]string{"monzo.com/keyspace": "ledger"}))
+
+	stored := func(key string) *saCacheObject {
+		entry, err := storage.Get(ctx, serviceAccountPath+key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil {
+			return nil
+		}
+		var mapping saCacheObject
+		if err := entry.DecodeJSON(&mapping); err != nil {
+			t.Fatal(err)
+		}
+		return &mapping
+	}
+
+	// the initial list is persisted by a full reconcile
+	if !w.mirror.reconcileDue() {
+		t.Fatal("expected a reconcile to be due after the initial list")
+	}
+	if err := b.syncServiceAccounts(ctx, &logical.Request{Storage: storage}); err != nil {
+		t.Fatal(err)
+	}
+	if mapping := stored("default/s-ledger"); mapping == nil || mapping.Keyspace != "ledger" {
+		t.Fatalf("expected s-ledger to be persisted, got %#v", mapping)
+	}
+	if w.mirror.reconcileDue() {
+		t.Fatal("expected no reconcile to be due")
+	}
+
+	// later changes are persisted as they are observed
+	added := testServiceAccount("default", "s-new", map[string]string{"monzo.com/keyspace": "new"})
+	added.ResourceVersion = "2"
+	fakeWatch.Add(&added)
+	waitFor(t, func() bool { return stored("default/s-new") != nil })
+
+	modified := testServiceAccount("default", "s-new", map[string]string{"monzo.com/keyspace": "new", "monzo.com/cluster": "staging"})
+	modified.ResourceVersion = "3"
+	fakeWatch.Modify(&modified)
+	waitFor(t, func() bool { return stored("default/s-new").DBName == "staging" })
+
+	// a change which does not affect the mapping is not written
+	puts := storage.putCount()
+	unrelated := testServiceAccount("default", "s-new", map[string]string{"monzo.com/keyspace": "new", "monzo.com/cluster": "staging", "team": "payments"})
+	unrelated.ResourceVersion = "4"
+	fakeWatch.Modify(&unrelated)
+
+	deleted := testServiceAccount("default", "s-ledger", nil)
+	deleted.ResourceVersion = "5"
+	fakeWatch.Delete(&deleted)
+	waitFor(t, func() bool { return stored("default/s-ledger") == nil })
+
+	if storage.putCount() != puts {
+		t.Fatalf("expected no writes, got %d", storage.putCount()-puts)
+	}
+
+	// syncing without a reconcile due writes nothing either
+	if err := b.syncServiceAccounts(ctx, &logical.Request{Storage: storage}); err != nil {
+		t.Fatal(err)
+	}
+	if storage.putCount() != puts {
+		t.Fatalf("expected no writes, got %d", storage.putCount()-puts)
+	}
+
+	// a reconcile requested while another runs does not wait for it, and is still due after
+	requests := w.mirror.reconcileRequests()
+	w.mirror.mtx.Lock()
+	w.mirror.requestReconcile()
+	w.mirror.mtx.Unlock()
+	w.mirror.reconciled(requests)
+	if !w.mirror.reconcileDue() {
+		t.Fatal("expected the reconcile requested while reconciling to be due")
+	}
+}
+
+func TestKubeConfig_deletionDefaults(t *testing.T) {
+	// configs stored before the fields were added get the defaults, while a config which
+	// disables them keeps them disabled
+	for stored, expected := range map[string][2]int{
+		`{"keyspace_annotation":"monzo.com/keyspace"}`:                                                       {3600, 100},
+		`{"keyspace_annotation":"monzo.com/keyspace","tombstone_grace_period":0,"max_deletions_per_sync":0}`: {0, 0},
+	} {
+		var config kubeConfig
+		if err := json.Unmarshal([]byte(stored), &config); err != nil {
+			t.Fatal(err)
+		}
+		if got := [2]int{int(config.tombstoneGracePeriod().Seconds()), config.maxDeletionsPerSync()}; got != expected {
+			t.Fatalf("%s: expected %v, got %v", stored, expected, got)
+		}
+	}
+}
+
+func TestBackend_reconcileServiceAccounts_deletions(t *testing.T) {
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	ctx := context.Background()
+	storage := config.StorageView
+	kubeconfig := &kubeConfig{KeyspaceAnnotation: "monzo.com/keyspace", TombstoneGracePeriod: newDurationPtr(time.Hour), MaxDeletionsPerSync: newIntPtr(1)}
+
+	for _, name := range []string{"s-a", "s-b"} {
+		if _, err := putServiceAccountMapping(ctx, storage, serviceAccountPath+"other/"+name, &saCacheObject{Keyspace: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stored := func(key string) *saCacheObject {
+		entry, err := storage.Get(ctx, serviceAccountPath+key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil {
+			return nil
+		}
+		var mapping saCacheObject
+		if err := entry.DecodeJSON(&mapping); err != nil {
+			t.Fatal(err)
+		}
+		return &mapping
+	}
+
+	w := &serviceAccountWatcher{cache: cache.NewStore(keyFunc), logger: b.logger}
+	mappings := map[string]*saCacheObject{"default/s-ledger": {Keyspace: "ledger"}}
+
+	// nothing is removed until the watcher has synced
+	if err := b.reconcileServiceAccounts(ctx, storage, "", kubeconfig, w, mappings, false); err != nil {
+		t.Fatal(err)
+	}
+	if stored("default/s-ledger") == nil {
+		t.Fatal("expected s-ledger to be written")
+	}
+	if mapping := stored("other/s-a"); mapping == nil || mapping.DeletedAt != nil {
+		t.Fatalf("expected s-a to be untouched, got %#v", mapping)
+	}
+
+	// more removals than allowed are refused, unless forced
+	w.status.recordReplace(metav1.NamespaceAll)
+	if err := b.reconcileServiceAccounts(ctx, storage, "", kubeconfig, w, mappings, false); err == nil {
+		t.Fatal("expected the deletions to be refused")
+	}
+	if mapping := stored("other/s-b"); mapping == nil || mapping.DeletedAt != nil {
+		t.Fatalf("expected s-b to be untouched, got %#v", mapping)
+	}
+	if err := b.reconcileServiceAccounts(ctx, storage, "", kubeconfig, w, mappings, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// removed mappings are tombstoned, and still reported, but no longer resolve virtual roles
+	for _, key := range []string{"other/s-a", "other/s-b"} {
+		if mapping := stored(key); mapping == nil || mapping.DeletedAt == nil {
+			t.Fatalf("expected %s to be tombstoned, got %#v", key, mapping)
+		}
+	}
+	mapping, source, err := b.lookupServiceAccount(ctx, storage, "", "other", "s-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping == nil || mapping.Keyspace != "s-a" || source != mappingSourceStorage {
+		t.Fatalf("expected the tombstoned mapping of s-a, got %#v from %s", mapping, source)
+	}
+	if mapping, err := b.getServiceAccountAnnotations(ctx, storage, "", "other", "s-a"); err != nil || mapping != nil {
+		t.Fatalf("expected no mapping to resolve virtual roles from, got %#v, %v", mapping, err)
+	}
+
+	// a service account which reappears is restored
+	mappings["other/s-b"] = &saCacheObject{Keyspace: "s-b"}
+	if err := b.reconcileServiceAccounts(ctx, storage, "", kubeconfig, w, mappings, false); err != nil {
+		t.Fatal(err)
+	}
+	if mapping := stored("other/s-b"); mapping == nil || mapping.DeletedAt != nil {
+		t.Fatalf("expected s-b to be restored, got %#v", mapping)
+	}
+
+	// tombstones are deleted once the grace period passes
+	tombstone := stored("other/s-a")
+	deletedAt := time.Now().Add(-2 * time.Hour)
+	tombstone.DeletedAt = &deletedAt
+	entry, err := logical.StorageEntryJSON(serviceAccountPath+"other/s-a", tombstone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.reconcileServiceAccounts(ctx, storage, "", kubeconfig, w, mappings, false); err != nil {
+		t.Fatal(err)
+	}
+	if mapping := stored("other/s-a"); mapping != nil {
+		t.Fatalf("expected s-a to be deleted, got %#v", mapping)
+	}
+}
+
+func TestBackend_replicationState(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name        string
+		state       consts.ReplicationState
+		localMount  bool
+		local       bool
+		watches     bool
+		localPrefix bool
+	}{
+		{name: "primary", state: consts.ReplicationPerformancePrimary, watches: true},
+		{name: "performance standby", state: consts.ReplicationPerformanceStandby},
+		{name: "dr secondary", state: consts.ReplicationDRSecondary, local: true},
+		{name: "performance secondary", state: consts.ReplicationPerformanceSecondary},
+		{name: "performance secondary, local mount", state: consts.ReplicationPerformanceSecondary, localMount: true, local: true, watches: true},
+		{name: "performance secondary, local mapping", state: consts.ReplicationPerformanceSecondary, local: true, watches: true, localPrefix: true},
+		{name: "performance secondary standby, local mapping", state: consts.ReplicationPerformanceSecondary | consts.ReplicationPerformanceStandby, local: true, localPrefix: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := logical.TestBackendConfig()
+			config.StorageView = &logical.InmemStorage{}
+			sys := logical.TestSystemView()
+			sys.ReplicationStateVal = tc.state
+			sys.LocalMountVal = tc.localMount
+			config.System = sys
+			b := Backend(config)
+			if err := b.Setup(ctx, config); err != nil {
+				t.Fatal(err)
+			}
+
+			kubeconfig := &kubeConfig{KeyspaceAnnotation: "monzo.com/keyspace", LocalMapping: tc.local}
+			if watches := b.watchesServiceAccounts(kubeconfig); watches != tc.watches {
+				t.Fatalf("expected watching to be %t, got %t", tc.watches, watches)
+			}
+
+			if !tc.watches {
+				if err := b.startWatcher(config.StorageView, "", kubeconfig); err != nil {
+					t.Fatal(err)
+				}
+				if b.watcher("") != nil {
+					t.Fatal("expected no watcher to be started")
+				}
+			}
+
+			expected := serviceAccountPath
+			if tc.localPrefix {
+				expected = localMappingPath + serviceAccountPath
+			}
+			if prefix := b.mappingStoragePrefix("", kubeconfig); prefix != expected {
+				t.Fatalf("expected mapping under %q, got %q", expected, prefix)
+			}
+		})
+	}
+}
+
+func TestServiceAccountStorageCluster(t *testing.T) {
+	for key, expected := range map[string]struct {
+		cluster string
+		ok      bool
+	}{
+		"serviceaccount/default/s-ledger":              {"", true},
+		"cluster/prod/serviceaccount/default/s-ledger": {"prod", true},
+		"cluster/prod/serviceaccount-lease/default/s":  {},
+		"serviceaccount-lease/default/s-ledger/v-1":    {},
+		"kubeconfig/prod":                              {},
+	} {
+		cluster, ok := serviceAccountStorageCluster(key)
+		if ok != expected.ok || cluster != expected.cluster {
+			t.Fatalf("%s: expected cluster %q (%t), got %q (%t)", key, expected.cluster, expected.ok, cluster, ok)
+		}
+	}
+}
+
+func TestBackend_invalidateKubeconfig(t *testing.T) {
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	ctx := context.Background()
+	kubeconfig := &kubeConfig{KeyspaceAnnotation: "monzo.com/keyspace"}
+	entry, err := logical.StorageEntryJSON(kubeconfigStorageKey("prod"), kubeconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StorageView.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &serviceAccountWatcher{
+		cache:  cache.NewStore(keyFunc),
+		logger: b.logger,
+		stopCh: make(chan struct{}),
+	}
+	w.mirror = newServiceAccountMirror(b, config.StorageView, "prod", kubeconfig, w.cache)
+	runTestWatcher(t, b, "prod", w)
+	w.mirror.reconciled(w.mirror.reconcileRequests())
+
+	// a change to the replicated mapping makes the next sync reconcile it
+	b.invalidate(ctx, "cluster/prod/serviceaccount/default/s-ledger")
+	if !w.mirror.reconcileDue() {
+		t.Fatal("expected a reconcile to be due")
+	}
+
+	// a secondary keeping a local mapping ignores changes to the replicated one
+	w.mirror.reconciled(w.mirror.reconcileRequests())
+	kubeconfig.LocalMapping = true
+	sys := config.System.(*logical.StaticSystemView)
+	sys.ReplicationStateVal = consts.ReplicationPerformanceSecondary
+	b.invalidate(ctx, "cluster/prod/serviceaccount/default/s-ledger")
+	sys.ReplicationStateVal = 0
+	kubeconfig.LocalMapping = false
+	if w.mirror.reconcileDue() {
+		t.Fatal("expected no reconcile to be due on a secondary keeping a local mapping")
+	}
+
+	// a change to another cluster's config leaves the watcher alone
+	b.invalidate(ctx, kubeconfigPath)
+	if b.watcher("prod") != w {
+		t.Fatal("expected the watcher to be kept")
+	}
+
+	// deleting the config on the active node stops the watcher
+	if err := config.StorageView.Delete(ctx, kubeconfigStorageKey("prod")); err != nil {
+		t.Fatal(err)
+	}
+	b.invalidate(ctx, kubeconfigStorageKey("prod"))
+	if b.watcher("prod") != nil {
+		t.Fatal("expected the watcher to be stopped")
+	}
+	select {
+	case <-w.stopCh:
+	default:
+		t.Fatal("expected the watcher's stop channel to be closed")
+	}
+}
+
+func TestBackend_kubeconfigDelete(t *testing.T) {
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	ctx := context.Background()
+	for _, cluster := range []string{"prod", "staging"} {
+		entry, err := logical.StorageEntryJSON(kubeconfigStorageKey(cluster), &kubeConfig{KeyspaceAnnotation: "monzo.com/keyspace"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := config.StorageView.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := putServiceAccountMapping(ctx, config.StorageView, serviceAccountStoragePrefix(cluster)+"default/s-ledger", &saCacheObject{Keyspace: "ledger"}); err != nil {
+			t.Fatal(err)
+		}
+		newTestWatcher(t, b, cluster)
+	}
+
+	// staging has a static role provisioned for s-ledger, and a lease issued to it
+	db := testFakeDatabase(t, b, config.StorageView)
+	db.users["s-ledger"] = "password"
+	db.users["v-ledger"] = "password"
+	role := &roleEntry{
+		DBName:        "db",
+		StaticAccount: &staticAccount{Username: "s-ledger", KubernetesMapping: &saCacheObject{Keyspace: "ledger"}},
+	}
+	entry, err := logical.StorageEntryJSON(databaseStaticRolePath+"k8s-staging_app_s-ledger_default", role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StorageView.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+	leaseKey := trackedLeaseKey(&k8sRoleName{Cluster: "staging", Namespace: "default", ServiceAccount: "s-ledger"}, "v-ledger")
+	lease := &trackedLease{
+		Role:       "k8s-staging_rw_s-ledger_default",
+		DBName:     "db",
+		Username:   "v-ledger",
+		Keyspaces:  []string{"ledger"},
+		Expiration: time.Now().Add(time.Hour),
+	}
+	if err := putTrackedLease(ctx, config.StorageView, leaseKey, lease); err != nil {
+		t.Fatal(err)
+	}
+
+	for cluster, purge := range map[string]bool{"prod": false, "staging": true} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "kubeconfig/" + cluster,
+			Storage:   config.StorageView,
+			Data:      map[string]interface{}{"purge_mappings": purge},
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, resp)
+		}
+
+		if b.watcher(cluster) != nil {
+			t.Fatalf("expected the watcher of %s to be stopped", cluster)
+		}
+		if conf, err := b.kubeconfig(ctx, config.StorageView, cluster); err != nil || conf != nil {
+			t.Fatalf("expected the config of %s to be deleted, got %#v, %v", cluster, conf, err)
+		}
+
+		mapping, err := b.getServiceAccountAnnotations(ctx, config.StorageView, cluster, "default", "s-ledger")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if purge && mapping != nil {
+			t.Fatalf("expected the mapping of %s to be purged, got %#v", cluster, mapping)
+		}
+		if !purge && (mapping == nil || mapping.Keyspace != "ledger") {
+			t.Fatalf("expected the mapping of %s to be kept, got %#v", cluster, mapping)
+		}
+	}
+
+	// purging dropped the user of the lease, which is kept until Vault revokes it, and the user
+	// of the provisioned static role
+	if _, ok := db.users["v-ledger"]; ok {
+		t.Fatal("expected the user of the lease to be dropped")
+	}
+	if lease, err := b.trackedLease(ctx, config.StorageView, leaseKey); err != nil || lease == nil || !lease.Revoked {
+		t.Fatalf("expected the lease to be recorded as revoked, got %#v, %v", lease, err)
+	}
+	if role, err := b.StaticRole(ctx, config.StorageView, "k8s-staging_app_s-ledger_default"); err != nil || role != nil {
+		t.Fatalf("expected the provisioned static role to be removed, got %#v, %v", role, err)
+	}
+	if _, ok := db.users["s-ledger"]; ok {
+		t.Fatal("expected the user of the provisioned static role to be dropped")
+	}
+}
+
+func TestBackend_reservedClusterNames(t *testing.T) {
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, name := range reservedClusterNames {
+		// kubeconfig/<reserved> must route to the subpath of the default cluster, which
+		// depends on the order of the backend's paths
+		var routed string
+		for _, p := range b.Paths {
+			pattern := p.Pattern
+			if !strings.HasPrefix(pattern, "^") {
+				pattern = "^" + pattern
+			}
+			if regexp.MustCompile(pattern).MatchString("kubeconfig/" + name) {
+				routed = p.Pattern
+				break
+			}
+		}
+		if !strings.HasSuffix(routed, "/"+name+"$") {
+			t.Fatalf("expected kubeconfig/%s to route to its own path, got %q", name, routed)
+		}
+
+		// the kubeconfig handlers refuse the name however they are reached
+		fields := pathKubeconfig(b)[0].Fields
+		for _, handler := range []framework.OperationFunc{b.pathKubeconfigWrite(), b.pathKubeconfigRead(), b.pathKubeconfigDelete()} {
+			resp, err := handler(ctx, &logical.Request{Storage: config.StorageView}, &framework.FieldData{
+				Raw:    map[string]interface{}{"name": name, "kubernetes_host": "https://localhost", "in_cluster": true, "skip_verify": true},
+				Schema: fields,
+			})
+			if err != nil || resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "reserved") {
+				t.Fatalf("expected cluster name %q to be reserved, got err:%v resp:%#v", name, err, resp)
+			}
+		}
+	}
+
+	// a name which cannot be parsed as a virtual role is an unknown role
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/k8s-missing",
+		Storage:   config.StorageView,
+	})
+	if err != nil || resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "unknown role") {
+		t.Fatalf("err:%v resp:%#v\n", err, resp)
+	}
+}
+
+type fakeServiceAccounts struct {
+	corev1client.ServiceAccountInterface
+	err error
+}
+
+func (f *fakeServiceAccounts) ServiceAccounts(string) corev1client.ServiceAccountInterface {
+	return f
+}
+
+func (f *fakeServiceAccounts) List(metav1.ListOptions) (*v1.ServiceAccountList, error) {
+	return &v1.ServiceAccountList{}, f.err
+}
+
+type fakeAccessReviews struct {
+	authorizationv1client.SelfSubjectAccessReviewInterface
+	allowed map[string]bool
+}
+
+func (f *fakeAccessReviews) SelfSubjectAccessReviews() authorizationv1client.SelfSubjectAccessReviewInterface {
+	return f
+}
+
+func (f *fakeAccessReviews) Create(review *authorizationv1.SelfSubjectAccessReview) (*authorizationv1.SelfSubjectAccessReview, error) {
+	review.Status.Allowed = f.allowed[review.Spec.ResourceAttributes.Verb]
+	return review, nil
+}
+
+func TestVerifyServiceAccountAccess(t *testing.T) {
+	testCases := map[string]struct {
+		listErr error
+		allowed map[string]bool
+		err     string
+	}{
+		"allowed": {
+			allowed: map[string]bool{"list": true, "watch": true},
+		},
+		"unreachable": {
+			listErr: errors.New("connection refused"),
+			err:     "error listing service accounts: connection refused",
+		},
+		"no watch": {
+			allowed: map[string]bool{"list": true},
+			err:     "credentials are not allowed to watch serviceaccounts in all namespaces",
+		},
+		"denied": {
+			err: "credentials are not allowed to list or watch serviceaccounts in all namespaces",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := verifyServiceAccountAccess(&fakeServiceAccounts{err: tc.listErr}, &fakeAccessReviews{allowed: tc.allowed}, []string{metav1.NamespaceAll})
+			if tc.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.err != "" && (err == nil || err.Error() != tc.err) {
+				t.Fatalf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestBackend_kubeconfigWrite_verify(t *testing.T) {
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	write := func(skipVerify bool) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "kubeconfig",
+			Storage:   config.StorageView,
+			Data: map[string]interface{}{
+				// nothing listens on port 1
+				"kubernetes_host":    "https://127.0.0.1:1",
+				"kubernetes_ca_cert": "ca",
+				"jwt":                "jwt",
+				"skip_verify":        skipVerify,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := write(false); resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "error verifying kubeconfig") {
+		t.Fatalf("expected a verification error, got %#v", resp)
+	}
+	if conf, err := b.kubeconfig(context.Background(), config.StorageView, ""); err != nil || conf != nil {
+		t.Fatalf("expected no config to be saved, got %#v, %v", conf, err)
+	}
+
+	if resp := write(true); resp != nil && resp.IsError() {
+		t.Fatalf("expected the config to be saved, got %#v", resp)
+	}
+	if conf, err := b.kubeconfig(context.Background(), config.StorageView, ""); err != nil || conf == nil {
+		t.Fatalf("expected the config to be saved, got %#v, %v", conf, err)
+	}
+}
+
+func TestServiceAccountWatcher_namespaces(t *testing.T) {
+	w := &serviceAccountWatcher{
+		cache:  cache.NewStore(keyFunc),
+		logger: log.NewNullLogger(),
+		stopCh: make(chan struct{}),
+	}
+	defer w.stop()
+	w.status.expectNamespaces([]string{"payments", "ledger"})
+
+	var mtx sync.Mutex
+	lists := map[string][]v1.ServiceAccount{
+		"payments": {testServiceAccount("payments", "s-payments", map[string]string{"monzo.com/team": "payments"}), testServiceAccount("payments", "s-old", nil)},
+	}
+	watches := map[string]*watch.FakeWatcher{}
+	listerWatchers := map[string]cache.ListerWatcher{}
+	for _, namespace := range []string{"payments", "ledger"} {
+		namespace, fakeWatch := namespace, watch.NewFake()
+		watches[namespace] = fakeWatch
+		listerWatchers[namespace] = &cache.ListWatch{
+			ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+				mtx.Lock()
+				defer mtx.Unlock()
+				items, ok := lists[namespace]
+				if !ok {
+					return nil, errors.New("unavailable")
+				}
+				return &v1.ServiceAccountList{ListMeta: metav1.ListMeta{ResourceVersion: "1"}, Items: items}, nil
+			},
+			WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+				return fakeWatch, nil
+			},
+		}
+	}
+	setList := func(namespace string, sas ...v1.ServiceAccount) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		lists[namespace] = sas
+	}
+
+	w.runReflectors(listerWatchers, nil, nil, time.Hour)
+	waitFor(t, func() bool { return len(w.cache.ListKeys()) == 2 })
+	if w.status.hasSynced() {
+		t.Fatal("expected the watcher not to be synced until every namespace is listed")
+	}
+
+	// the reflectors wait a second before retrying a failed list or watch
+	setList("ledger", testServiceAccount("ledger", "s-ledger", nil))
+	waitForTimeout(t, 5*time.Second, w.status.hasSynced)
+
+	// relisting a namespace leaves the others alone
+	setList("payments", testServiceAccount("payments", "s-payments", map[string]string{"monzo.com/team": "payments"}))
+	watches["payments"].Stop()
+	waitForTimeout(t, 5*time.Second, func() bool { return len(w.cache.ListKeys()) == 2 })
+
+	for _, key := range []string{"payments/s-payments", "ledger/s-ledger"} {
+		if _, ok, _ := w.cache.GetByKey(key); !ok {
+			t.Fatalf("expected %s to be cached", key)
+		}
+	}
+}
+
+func TestServiceAccountWatcher_relist(t *testing.T) {
+	w := &serviceAccountWatcher{
+		cache:  cache.NewStore(keyFunc),
+		logger: log.NewNullLogger(),
+		stopCh: make(chan struct{}),
+	}
+	defer w.stop()
+
+	var mtx sync.Mutex
+	sas := []v1.ServiceAccount{testServiceAccount("payments", "s-payments", nil)}
+	w.runReflectors(map[string]cache.ListerWatcher{metav1.NamespaceAll: &cache.ListWatch{
+		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			return &v1.ServiceAccountList{ListMeta: metav1.ListMeta{ResourceVersion: "1"}, Items: sas}, nil
+		},
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+			// a watch which never delivers the change, so only a relist picks it up
+			return watch.NewFake(), nil
+		},
+	}}, nil, nil, 10*time.Millisecond)
+	waitFor(t, w.status.hasSynced)
+
+	mtx.Lock()
+	sas = append(sas, testServiceAccount("payments", "s-missed", nil))
+	mtx.Unlock()
+
+	// the reflectors wait a second before listing again
+	waitForTimeout(t, 5*time.Second, func() bool {
+		_, ok, _ := w.cache.GetByKey("payments/s-missed")
+		return ok
+	})
+
+	// configs stored before resync_period was added relist hourly
+	var config kubeConfig
+	if err := json.Unmarshal([]byte(`{"keyspace_annotation":"monzo.com/keyspace"}`), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.resyncPeriod() != defaultResyncPeriod {
+		t.Fatalf("expected the default resync period, got %s", config.resyncPeriod())
+	}
+}
+
+func TestServiceAccountWatcher_compact(t *testing.T) {
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	kubeconfig := &kubeConfig{
+		KeyspaceAnnotation:  "monzo.com/keyspace",
+		DBNameAnnotation:    "monzo.com/cluster",
+		AnnotationVariables: map[string]string{"team": "monzo.com/team"},
+		LabelVariables:      map[string]string{"app": "app"},
+	}
+
+	sa := testServiceAccount("default", "s-ledger", map[string]string{
+		"monzo.com/keyspace": "ledger",
+		"monzo.com/team":     "payments",
+		"kubectl.kubernetes.io/last-applied-configuration": "{}",
+	})
+	sa.UID = "uid"
+	sa.ResourceVersion = "7"
+	sa.Labels = map[string]string{"app": "ledger", "pod-template-hash": "abc"}
+	sa.Secrets = []v1.ObjectReference{{Name: "s-ledger-token"}}
+
+	w := &serviceAccountWatcher{
+		cache:    cache.NewStore(keyFunc),
+		logger:   b.logger,
+		stopCh:   make(chan struct{}),
+		retained: kubeconfig.retainedMetadata(),
+	}
+	runTestWatcher(t, b, "", w, sa)
+
+	obj, ok, err := w.cache.GetByKey("default/s-ledger")
+	if err != nil || !ok {
+		t.Fatalf("expected s-ledger to be cached: %v", err)
+	}
+
+	expected := &v1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            "s-ledger",
+			UID:             "uid",
+			ResourceVersion: "7",
+			Annotations:     map[string]string{"monzo.com/keyspace": "ledger", "monzo.com/team": "payments"},
+			Labels:          map[string]string{"app": "ledger"},
+		},
+	}
+	if diff := deep.Equal(expected, obj); diff != nil {
+		t.Fatal(diff)
+	}
+
+	compacted, err := b.getObjectAnnotations(kubeconfig, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := b.getObjectAnnotations(kubeconfig, &sa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(original, compacted); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestBackend_namespaceDefaults(t *testing.T) {
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	ctx := context.Background()
+	kubeconfig := &kubeConfig{KeyspaceAnnotation: "monzo.com/keyspace", DBNameAnnotation: "monzo.com/cluster", NamespaceDefaults: true}
+	entry, err := logical.StorageEntryJSON(kubeconfigPath, kubeconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StorageView.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	namespace := func(name, resourceVersion string, annotations map[string]string) *v1.Namespace {
+		return &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, ResourceVersion: resourceVersion, Annotations: annotations}}
+	}
+
+	w := &serviceAccountWatcher{
+		cache:      cache.NewStore(keyFunc),
+		namespaces: cache.NewStore(cache.MetaNamespaceKeyFunc),
+		logger:     b.logger,
+		stopCh:     make(chan struct{}),
+	}
+	w.status.expectNamespaces([]string{metav1.NamespaceAll, namespacesReflectorKey})
+	w.mirror = newServiceAccountMirror(b, config.StorageView, "", kubeconfig, w.cache)
+	w.mirror.namespaces = w.namespaces
+	w.mirror.reconciled(w.mirror.reconcileRequests())
+	go w.mirror.run(w.stopCh)
+
+	namespaceWatch := watch.NewFake()
+	w.runReflectors(map[string]cache.ListerWatcher{}, &cache.ListWatch{
+		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+			return &v1.NamespaceList{ListMeta: metav1.ListMeta{ResourceVersion: "1"}, Items: []v1.Namespace{
+				*namespace("payments", "1", map[string]string{"monzo.com/keyspace": "payments", "monzo.com/cluster": "staging"}),
+			}}, nil
+		},
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+			return namespaceWatch, nil
+		},
+	}, nil, time.Hour)
+	waitFor(t, func() bool { return len(w.namespaces.ListKeys()) == 1 })
+
+	// the namespace reflector is stopped when the service account reflector is started, but
+	// the namespace cache is kept
+	runTestWatcher(t, b, "", w,
+		testServiceAccount("payments", "s-payments", map[string]string{"monzo.com/team": "payments"}),
+		testServiceAccount("payments", "s-ledger", map[string]string{"monzo.com/keyspace": "ledger"}),
+		testServiceAccount("other", "s-other", nil),
+	)
+
+	for name, expected := range map[string]*saCacheObject{
+		"s-payments": {Keyspace: "payments", DBName: "staging", KeyspaceLevel: mappingLevelNamespace, DBNameLevel: mappingLevelNamespace},
+		"s-ledger":   {Keyspace: "ledger", DBName: "staging", DBNameLevel: mappingLevelNamespace},
+	} {
+		mapping, err := b.getServiceAccountAnnotations(ctx, config.StorageView, "", "payments", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := deep.Equal(expected, mapping); diff != nil {
+			t.Fatal(name, diff)
+		}
+	}
+
+	mapping, err := b.getServiceAccountAnnotations(ctx, config.StorageView, "", "other", "s-other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping == nil || mapping.Keyspace != "" {
+		t.Fatalf("expected s-other to be unmapped, got %#v", mapping)
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "serviceaccounts/payments/s-payments",
+		Storage:   config.StorageView,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+	if resp.Data["keyspace_level"] != mappingLevelNamespace {
+		t.Fatalf("expected the keyspace to come from the namespace, got %#v", resp.Data)
+	}
+
+	// re-annotating a namespace persists the mappings of its service accounts
+	store := &namespaceEventStore{Store: w.namespaces, mirror: w.mirror}
+	if err := store.Update(namespace("payments", "2", map[string]string{"monzo.com/keyspace": "billing"})); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		entry, err := config.StorageView.Get(ctx, serviceAccountPath+"payments/s-payments")
+		if err != nil || entry == nil {
+			return false
+		}
+		var stored saCacheObject
+		return entry.DecodeJSON(&stored) == nil && stored.Keyspace == "billing" && stored.KeyspaceLevel == mappingLevelNamespace
+	})
+}
+
+// fakeDatabaseAccesses records the status updates of DatabaseAccess resources, applying them
+// to the watcher's cache as a watch event would
+type fakeDatabaseAccesses struct {
+	dynamic.NamespaceableResourceInterface
+	store   cache.Store
+	updated map[string]*unstructured.Unstructured
+}
+
+func (f *fakeDatabaseAccesses) Namespace(string) dynamic.ResourceInterface {
+	return f
+}
+
+func (f *fakeDatabaseAccesses) UpdateStatus(obj *unstructured.Unstructured, _ metav1.UpdateOptions) (*unstructured.Unstructured, error) {
+	f.updated[obj.GetName()] = obj
+	return obj, f.store.Update(obj)
+}
+
+func testDatabaseAccess(namespace, name string, spec map[string]interface{}) unstructured.Unstructured {
+	return unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "vault.monzo.com/v1alpha1",
+		"kind":       "DatabaseAccess",
+		"metadata": map[string]interface{}{
+			"namespace":  namespace,
+			"name":       name,
+			"generation": int64(1),
+		},
+		"spec": spec,
+	}}
+}
+
+func TestBackend_databaseAccess(t *testing.T) {
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	ctx := context.Background()
+	put := func(key string, value interface{}) {
+		entry, err := logical.StorageEntryJSON(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := config.StorageView.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kubeconfig := &kubeConfig{
+		KeyspaceAnnotation:  "monzo.com/keyspace",
+		DBNameAnnotation:    "monzo.com/cluster",
+		AnnotationVariables: map[string]string{"team": "monzo.com/team"},
+		GrantSource:         grantSourceDatabaseAccess,
+	}
+	put(kubeconfigPath, kubeconfig)
+	put(databaseRolePath+"rw", &roleEntry{DBName: "db", AllowedDBNameOverrides: []string{"db-*"}, Statements: dbplugin.Statements{Creation: []string{"GRANT {{annotations.team}} ON {{annotation}}"}}})
+
+	w := &serviceAccountWatcher{
+		cache:  cache.NewStore(keyFunc),
+		grants: newDatabaseAccessIndexer(),
+		logger: b.logger,
+		stopCh: make(chan struct{}),
+	}
+	w.status.expectNamespaces([]string{metav1.NamespaceAll, grantsReflectorKey})
+	client := &fakeDatabaseAccesses{store: w.grants, updated: map[string]*unstructured.Unstructured{}}
+	w.grantClient = client
+
+	grants := []unstructured.Unstructured{
+		testDatabaseAccess("payments", "ledger", map[string]interface{}{"serviceAccount": "s-ledger", "role": "rw", "keyspaces": []interface{}{"ledger", "audit"}}),
+		testDatabaseAccess("payments", "ledger-extra", map[string]interface{}{"serviceAccount": "s-ledger", "role": "rw", "keyspaces": []interface{}{"audit", "extra"}}),
+		testDatabaseAccess("payments", "missing", map[string]interface{}{"serviceAccount": "s-missing", "role": "rw", "keyspaces": []interface{}{"ledger"}}),
+		testDatabaseAccess("payments", "invalid", map[string]interface{}{"serviceAccount": "s-ledger", "role": "rw", "keyspaces": []interface{}{"ledger; DROP"}}),
+		testDatabaseAccess("payments", "no-role", map[string]interface{}{"serviceAccount": "s-ledger", "role": "ro", "keyspaces": []interface{}{"ledger"}}),
+		testDatabaseAccess("payments", "ledger-eu", map[string]interface{}{"serviceAccount": "s-ledger", "role": "rw", "keyspaces": []interface{}{"eu"}, "cluster": "db-eu"}),
+		testDatabaseAccess("payments", "payments", map[string]interface{}{"serviceAccount": "s-payments", "role": "rw", "keyspaces": []interface{}{"payments"}, "cluster": "db-eu"}),
+		testDatabaseAccess("payments", "payments-other", map[string]interface{}{"serviceAccount": "s-payments", "role": "rw", "keyspaces": []interface{}{"payments"}, "cluster": "other"}),
+	}
+	w.runReflectors(nil, nil, map[string]cache.ListerWatcher{metav1.NamespaceAll: &cache.ListWatch{
+		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+			list := &unstructured.UnstructuredList{Items: grants}
+			list.SetResourceVersion("1")
+			return list, nil
+		},
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+			return watch.NewFake(), nil
+		},
+	}}, time.Hour)
+	waitFor(t, func() bool { return len(w.grants.ListKeys()) == len(grants) })
+
+	// the grants reflector is stopped when the service account reflector is started, but the
+	// grants cache is kept
+	ledger := testServiceAccount("payments", "s-ledger", map[string]string{"monzo.com/team": "core"})
+	runTestWatcher(t, b, "", w, ledger, testServiceAccount("payments", "s-payments", map[string]string{"monzo.com/team": "payments"}), testServiceAccount("payments", "s-annotated", map[string]string{"monzo.com/keyspace": "annotated"}))
+
+	role, err := b.Role(ctx, config.StorageView, "k8s_rw_s-ledger_payments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role == nil {
+		t.Fatal("expected the grants of s-ledger to resolve")
+	}
+	if diff := deep.Equal([]string{"GRANT core ON ledger", "GRANT core ON audit", "GRANT core ON extra"}, role.Statements.Creation); diff != nil {
+		t.Fatal(diff)
+	}
+	if role.DBName != "db" {
+		t.Fatalf("expected the database of the concrete role, got %s", role.DBName)
+	}
+
+	// a grant's cluster overrides the database of the concrete role
+	role, err = b.Role(ctx, config.StorageView, "k8s_rw_s-payments_payments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role == nil || role.DBName != "db-eu" {
+		t.Fatalf("expected the grant of s-payments to resolve to db-eu, got %#v", role)
+	}
+
+	// annotations grant nothing
+	role, err = b.Role(ctx, config.StorageView, "k8s_rw_s-annotated_payments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role != nil {
+		t.Fatalf("expected annotations to be ignored, got %#v", role)
+	}
+
+	// a performance standby leaves the status of resources to the active node
+	sys := config.System.(*logical.StaticSystemView)
+	sys.ReplicationStateVal = consts.ReplicationPerformanceStandby
+	if err := b.syncServiceAccounts(ctx, &logical.Request{Storage: config.StorageView}); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.updated) != 0 {
+		t.Fatalf("expected no status updates on a performance standby, got %d", len(client.updated))
+	}
+	sys.ReplicationStateVal = 0
+
+	if err := b.syncServiceAccounts(ctx, &logical.Request{Storage: config.StorageView}); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"ledger":         reasonGranted,
+		"ledger-extra":   reasonGranted,
+		"missing":        reasonServiceAccountNotFound,
+		"invalid":        reasonRejectedValues,
+		"no-role":        reasonRoleNotFound,
+		"ledger-eu":      reasonConflictingCluster,
+		"payments":       reasonGranted,
+		"payments-other": reasonDBNameNotAllowed,
+	} {
+		obj, ok := client.updated[name]
+		if !ok {
+			t.Fatalf("expected the status of %s to be updated", name)
+		}
+		conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+		if len(conditions) != 1 {
+			t.Fatalf("expected a single condition on %s, got %#v", name, conditions)
+		}
+		condition := conditions[0].(map[string]interface{})
+		status := string(metav1.ConditionFalse)
+		if expected == reasonGranted {
+			status = string(metav1.ConditionTrue)
+		}
+		if condition["type"] != conditionReady || condition["reason"] != expected || condition["status"] != status {
+			t.Fatalf("unexpected condition on %s: %#v", name, condition)
+		}
+	}
+
+	// unchanged conditions are not written again
+	client.updated = map[string]*unstructured.Unstructured{}
+	if err := b.syncServiceAccounts(ctx, &logical.Request{Storage: config.StorageView}); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.updated) != 0 {
+		t.Fatalf("expected no status updates, got %d", len(client.updated))
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "kubeconfig/status",
+		Storage:   config.StorageView,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+	if resp.Data["grant_count"] != len(grants) {
+		t.Fatalf("expected %d grants to be reported, got %#v", len(grants), resp.Data["grant_count"])
+	}
+
+	// a node which does not watch a cluster granting through DatabaseAccess resources forwards
+	// the request to one which does
+	put(kubeconfigStorageKey("staging"), kubeconfig)
+	sys.ReplicationStateVal = consts.ReplicationPerformanceStandby
+	if _, err := b.Role(ctx, config.StorageView, "k8s-staging_rw_s-ledger_payments"); err != logical.ErrReadOnly {
+		t.Fatalf("expected the request to be forwarded, got %v", err)
+	}
+	sys.ReplicationStateVal = 0
+	if _, err := b.Role(ctx, config.StorageView, "k8s-staging_rw_s-ledger_payments"); err == nil || err == logical.ErrReadOnly {
+		t.Fatalf("expected an error on a node which should watch the cluster, got %v", err)
+	}
+}
+
+func TestBackend_annotationPattern(t *testing.T) {
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopWatchers()
+
+	ctx := context.Background()
+	put := func(key string, value interface{}) {
+		entry, err := logical.StorageEntryJSON(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := config.StorageView.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(kubeconfigPath, &kubeConfig{KeyspaceAnnotation: "monzo.com/keyspace", DBNameAnnotation: "monzo.com/cluster"})
+	statements := dbplugin.Statements{Creation: []string{"GRANT ALL ON SCHEMA {{annotation}}"}}
+	put(databaseRolePath+"rw", &roleEntry{DBName: "db", Statements: statements})
+	put(databaseRolePath+"schema", &roleEntry{DBName: "db", Statements: statements, AnnotationPattern: `^[\w.-]+$`})
+	put(databaseRolePath+"sensitive", &roleEntry{DBName: "db", Statements: statements, AnnotationPattern: `^ledger$`})
+	put(databaseRolePath+"unanchored", &roleEntry{DBName: "db", Statements: statements, AnnotationPattern: `[\w.]+`})
+
+	newTestWatcher(t, b, "",
+		testServiceAccount("default", "s-ledger", map[string]string{"monzo.com/keyspace": "ledger-eu"}),
+		testServiceAccount("default", "s-plain", map[string]string{"monzo.com/keyspace": "plain"}),
+		testServiceAccount("default", "s-inject", map[string]string{"monzo.com/keyspace": "plain; DROP KEYSPACE ledger"}),
+	)
+
+	// the kubeconfig's default pattern rejects hyphens
+	if _, err := b.Role(ctx, config.StorageView, "k8s_rw_s-ledger_default"); err == nil || !strings.Contains(err.Error(), "ledger-eu") {
+		t.Fatalf("expected ledger-eu to be rejected, got %v", err)
+	}
+
+	// a role can loosen the pattern
+	role, err := b.Role(ctx, config.StorageView, "k8s_schema_s-ledger_default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal([]string{"GRANT ALL ON SCHEMA ledger-eu"}, role.Statements.Creation); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// or tighten it
+	if _, err := b.Role(ctx, config.StorageView, "k8s_sensitive_s-plain_default"); err == nil {
+		t.Fatal("expected plain to be rejected by the role's pattern")
+	}
+	if role, err := b.Role(ctx, config.StorageView, "k8s_rw_s-plain_default"); err != nil || role == nil {
+		t.Fatalf("expected plain to be accepted by the default pattern, got %v", err)
+	}
+
+	// patterns must match values in full, even when not anchored
+	if role, err := b.Role(ctx, config.StorageView, "k8s_unanchored_s-plain_default"); err != nil || role == nil {
+		t.Fatalf("expected plain to be accepted by the unanchored pattern, got %v", err)
+	}
+	if _, err := b.Role(ctx, config.StorageView, "k8s_unanchored_s-inject_default"); err == nil {
+		t.Fatal("expected a partial match of the unanchored pattern to be rejected")
+	}
+	if _, err := compileAnnotationPattern(`a)|(b`); err == nil {
+		t.Fatal("expected an unbalanced pattern to be rejected rather than balanced by anchoring")
+	}
+
+	// rejected values are kept in the mapping, and reported
+	if err := b.syncServiceAccounts(ctx, &logical.Request{Storage: config.StorageView}); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := config.StorageView.Get(ctx, serviceAccountPath+"default/s-ledger")
+	if err != nil || entry == nil {
+		t.Fatalf("expected the mapping of s-ledger to be stored, got %v", err)
+	}
+
+	handle := func(path string) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      path,
+			Storage:   config.StorageView,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%s resp:%#v\n", err, resp)
+		}
+		return resp
+	}
+
+	resp := handle("serviceaccounts/default/s-ledger")
+	if diff := deep.Equal([]string{"ledger-eu"}, resp.Data["rejected_values"]); diff != nil {
+		t.Fatal(diff)
+	}
+
+	resp = handle("kubeconfig/status")
+	if diff := deep.Equal(map[string][]string{"default/s-inject": {"plain; DROP KEYSPACE ledger"}, "default/s-ledger": {"ledger-eu"}}, resp.Data["rejected_values"]); diff != nil {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,462 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// grantSourceAnnotations and grantSourceDatabaseAccess are the values of grant_source:
+	// service accounts are granted keyspaces either by their annotations, or by DatabaseAccess
+	// resources
+	grantSourceAnnotations    = "annotations"
+	grantSourceDatabaseAccess = "database_access"
+
+	// grantsReflectorKey prefixes the namespace of each reflector watching DatabaseAccess
+	// resources, to tell them apart from those watching service accounts
+	grantsReflectorKey = "/databaseaccesses/"
+)
+
+// databaseAccessResource is the custom resource granting a service account the keyspaces it
+// may use through a concrete role
+var databaseAccessResource = schema.GroupVersionResource{
+	Group:    "vault.monzo.com",
+	Version:  "v1alpha1",
+	Resource: "databaseaccesses",
+}
+
+// The Ready condition written to the status of DatabaseAccess resources, and its reasons
+const (
+	conditionReady = "Ready"
+
+	reasonGranted                = "Granted"
+	reasonInvalidSpec            = "InvalidSpec"
+	reasonServiceAccountNotFound = "ServiceAccountNotFound"
+	reasonRoleNotFound           = "RoleNotFound"
+	reasonRejectedValues         = "RejectedValues"
+	reasonDBNameNotAllowed       = "DBNameNotAllowed"
+	reasonConflictingCluster     = "ConflictingCluster"
+)
+
+// grantsFromResources reports whether virtual roles of the cluster are resolved from
+// DatabaseAccess resources rather than from service account annotations
+func (c *kubeConfig) grantsFromResources() bool {
+	return c.GrantSource == grantSourceDatabaseAccess
+}
+
+// databaseAccessSpec is the spec of a DatabaseAccess resource
+type databaseAccessSpec struct {
+	ServiceAccount string   `json:"serviceAccount"`
+	Role           string   `json:"role"`
+	Keyspaces      []string `json:"keyspaces"`
+	// Cluster overrides the database of the concrete role, like the db_name annotation of a
+	// service account. If empty, the role's own database is used.
+	Cluster string `json:"cluster,omitempty"`
+}
+
+// databaseAccessGrant is a DatabaseAccess resource read from the watcher's cache
+type databaseAccessGrant struct {
+	obj       *unstructured.Unstructured
+	namespace string
+	spec      databaseAccessSpec
+	// err is set if the spec of the resource is invalid
+	err error
+}
+
+// newDatabaseAccessGrant reads a DatabaseAccess resource, validating its spec
+func newDatabaseAccessGrant(obj interface{}) (*databaseAccessGrant, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object of type %T", obj)
+	}
+
+	g := &databaseAccessGrant{
+		obj:       u,
+		namespace: u.GetNamespace(),
+	}
+
+	spec, _, err := unstructured.NestedMap(u.Object, "spec")
+	if err != nil {
+		g.err = err
+		return g, nil
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(spec, &g.spec); err != nil {
+		g.err = err
+		return g, nil
+	}
+
+	g.err = g.spec.validate()
+	return g, nil
+}
+
+// validate checks that a spec names a service account, a concrete role and keyspaces. The
+// keyspaces are checked against the annotation_pattern of the role when it is applied.
+func (s *databaseAccessSpec) validate() error {
+	if s.ServiceAccount == "" || s.Role == "" {
+		return errors.New("spec.serviceAccount and spec.role must be set")
+	}
+	if isKubernetesRoleName(s.Role) {
+		return fmt.Errorf("spec.role %q must be a concrete role, not a virtual role", s.Role)
+	}
+	if len(s.Keyspaces) == 0 {
+		return errors.New("spec.keyspaces must not be empty")
+	}
+	return nil
+}
+
+// serviceAccountKey returns the namespace/name of the service account granted access
+func (g *databaseAccessGrant) serviceAccountKey() string {
+	return g.namespace + "/" + g.spec.ServiceAccount
+}
+
+// grantedRoleIndex indexes DatabaseAccess resources by the namespace/serviceAccount/role they
+// grant access to, so that resolving a virtual role only reads its own grants
+const grantedRoleIndex = "grantedRole"
+
+// newDatabaseAccessIndexer returns the cache of DatabaseAccess resources
+func newDatabaseAccessIndexer() cache.Indexer {
+	return cache.NewIndexer(keyFunc, cache.Indexers{grantedRoleIndex: grantedRoleIndexFunc})
+}
+
+// grantedRoleIndexFunc returns the namespace/serviceAccount/role a DatabaseAccess resource
+// grants. Resources with an invalid spec are not indexed.
+func grantedRoleIndexFunc(obj interface{}) ([]string, error) {
+	g, err := newDatabaseAccessGrant(obj)
+	if err != nil || g.err != nil {
+		return nil, nil
+	}
+	return []string{grantedRoleKey(g.namespace, g.spec.ServiceAccount, g.spec.Role)}, nil
+}
+
+func grantedRoleKey(namespace, serviceAccount, role string) string {
+	return namespace + "/" + serviceAccount + "/" + role
+}
+
+// databaseAccessGrants returns the DatabaseAccess resources in the watcher's cache, ordered by
+// namespace and name
+func (w *serviceAccountWatcher) databaseAccessGrants() []*databaseAccessGrant {
+	return w.readDatabaseAccessGrants(w.grants.List())
+}
+
+// roleDatabaseAccessGrants returns the DatabaseAccess resources in the watcher's cache which
+// grant a virtual role, ordered by namespace and name
+func (w *serviceAccountWatcher) roleDatabaseAccessGrants(k8sName *k8sRoleName) ([]*databaseAccessGrant, error) {
+	objs, err := w.grants.ByIndex(grantedRoleIndex, grantedRoleKey(k8sName.Namespace, k8sName.ServiceAccount, k8sName.Role))
+	if err != nil {
+		return nil, err
+	}
+	return w.readDatabaseAccessGrants(objs), nil
+}
+
+// readDatabaseAccessGrants reads the DatabaseAccess resources among objs, ordered by namespace
+// and name
+func (w *serviceAccountWatcher) readDatabaseAccessGrants(objs []interface{}) []*databaseAccessGrant {
+	var grants []*databaseAccessGrant
+	for _, obj := range objs {
+		g, err := newDatabaseAccessGrant(obj)
+		if err != nil {
+			w.logger.Error("error reading DatabaseAccess resource", "error", err)
+			continue
+		}
+		grants = append(grants, g)
+	}
+
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].namespace != grants[j].namespace {
+			return grants[i].namespace < grants[j].namespace
+		}
+		return grants[i].obj.GetName() < grants[j].obj.GetName()
+	})
+
+	return grants
+}
+
+// databaseAccessMappings merges the grants which can be applied into the mapping of each
+// service account and concrete role of a cluster, keyed by namespace/name/role. A grant is
+// applied if its service account is cached, its concrete role exists, its keyspaces and the
+// template variable values of its service account match the role's annotation_pattern, and
+// the role allows its database, which must agree with the other grants of the role. Template
+// variables are still read from the service account's annotations and labels. The grants
+// which cannot be applied are returned with the reason.
+func (b *databaseBackend) databaseAccessMappings(ctx context.Context, s logical.Storage, cluster string, config *kubeConfig, w *serviceAccountWatcher, grants []*databaseAccessGrant) (map[string]*saCacheObject, map[*databaseAccessGrant]grantError, error) {
+	mappings := map[string]*saCacheObject{}
+	failed := map[*databaseAccessGrant]grantError{}
+	roles := map[string]*roleEntry{}
+
+	for _, g := range grants {
+		if g.err != nil {
+			failed[g] = grantError{reasonInvalidSpec, g.err}
+			continue
+		}
+
+		sa, exists, err := w.cache.GetByKey(g.serviceAccountKey())
+		if err != nil || !exists {
+			failed[g] = grantError{reasonServiceAccountNotFound, fmt.Errorf("service account %s is not watched", g.serviceAccountKey())}
+			continue
+		}
+
+		role, ok := roles[g.spec.Role]
+		if !ok {
+			role, err = b.Role(ctx, s, g.spec.Role)
+			if err != nil {
+				return nil, nil, err
+			}
+			roles[g.spec.Role] = role
+		}
+		if role == nil {
+			failed[g] = grantError{reasonRoleNotFound, fmt.Errorf("concrete role %s does not exist", g.spec.Role)}
+			continue
+		}
+
+		granted, err := serviceAccountTemplateValues(config, sa)
+		if err != nil {
+			return nil, nil, err
+		}
+		granted.Keyspaces = g.spec.Keyspaces
+
+		pattern, err := annotationPattern(role, config)
+		if err != nil {
+			return nil, nil, err
+		}
+		if rejected := granted.rejectedValues(pattern); len(rejected) > 0 {
+			failed[g] = grantError{reasonRejectedValues, fmt.Errorf("values %q do not match annotation_pattern %s of role %s", rejected, rolePattern(role, config), g.spec.Role)}
+			continue
+		}
+
+		k8sName := &k8sRoleName{Cluster: cluster, Role: g.spec.Role, Namespace: g.namespace, ServiceAccount: g.spec.ServiceAccount}
+		if g.spec.Cluster != "" {
+			if err := role.checkDBNameOverride(k8sName, g.spec.Cluster); err != nil {
+				failed[g] = grantError{reasonDBNameNotAllowed, err}
+				continue
+			}
+		}
+		granted.DBName = g.spec.Cluster
+
+		key := grantedRoleKey(g.namespace, g.spec.ServiceAccount, g.spec.Role)
+		mapping, ok := mappings[key]
+		if !ok {
+			mapping = granted
+			mapping.Keyspaces = nil
+			mappings[key] = mapping
+		}
+		if mapping.DBName != granted.DBName {
+			failed[g] = grantError{reasonConflictingCluster, fmt.Errorf("cluster %q conflicts with cluster %q of another DatabaseAccess granting role %s to service account %s",
+				granted.DBName, mapping.DBName, g.spec.Role, g.serviceAccountKey())}
+			continue
+		}
+
+		for _, keyspace := range g.spec.Keyspaces {
+			if !containsString(mapping.keyspaces(), keyspace) {
+				mapping.Keyspaces = append(mapping.keyspaces(), keyspace)
+			}
+		}
+		mapping.Keyspace = mapping.Keyspaces[0]
+	}
+
+	for _, mapping := range mappings {
+		if len(mapping.Keyspaces) == 1 {
+			mapping.Keyspaces = nil
+		}
+	}
+
+	return mappings, failed, nil
+}
+
+// grantError is why a grant could not be applied, with the reason of its Ready condition
+type grantError struct {
+	reason string
+	err    error
+}
+
+// serviceAccountTemplateValues returns a mapping holding only the values of the configured
+// template variables of a service account
+func serviceAccountTemplateValues(config *kubeConfig, sa interface{}) (*saCacheObject, error) {
+	saMeta, err := meta.Accessor(sa)
+	if err != nil {
+		return nil, err
+	}
+
+	return &saCacheObject{
+		Annotations: templateVariableValues(config.AnnotationVariables, saMeta.GetAnnotations()),
+		Labels:      templateVariableValues(config.LabelVariables, saMeta.GetLabels()),
+	}, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// kubernetesMapping returns the mapping a virtual role applies to its concrete role: that of
+// its DatabaseAccess resources if the cluster grants access through them, or else that of the
+// service account's annotations. A nil mapping means the service account has no access.
+func (b *databaseBackend) kubernetesMapping(ctx context.Context, s logical.Storage, k8sName *k8sRoleName) (*saCacheObject, error) {
+	config, err := b.kubeconfig(ctx, s, k8sName.Cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil || !config.grantsFromResources() {
+		return b.getServiceAccountAnnotations(ctx, s, k8sName.Cluster, k8sName.Namespace, k8sName.ServiceAccount)
+	}
+
+	// Grants are not persisted, so they can only be served once they have been listed. Nodes
+	// which do not watch the cluster, such as performance standbys, forward the request to one
+	// which does.
+	w := b.watcher(k8sName.Cluster)
+	if w == nil || w.grants == nil {
+		if !b.watchesServiceAccounts(config) {
+			return nil, logical.ErrReadOnly
+		}
+		return nil, fmt.Errorf("DatabaseAccess resources of cluster %s are not watched on this node", clusterDisplayName(k8sName.Cluster))
+	}
+	if !w.status.hasSynced() {
+		return nil, fmt.Errorf("DatabaseAccess resources of cluster %s have not been listed yet", clusterDisplayName(k8sName.Cluster))
+	}
+
+	grants, err := w.roleDatabaseAccessGrants(k8sName)
+	if err != nil {
+		return nil, err
+	}
+
+	mappings, _, err := b.databaseAccessMappings(ctx, s, k8sName.Cluster, config, w, grants)
+	if err != nil {
+		return nil, err
+	}
+	return mappings[grantedRoleKey(k8sName.Namespace, k8sName.ServiceAccount, k8sName.Role)], nil
+}
+
+// syncDatabaseAccess writes the Ready condition of each DatabaseAccess resource of a cluster,
+// and revokes the leases of grants which have been removed. Both are left to the nodes which
+// write replicated storage, so that each resource has a single writer.
+func (b *databaseBackend) syncDatabaseAccess(ctx context.Context, s logical.Storage, cluster string, config *kubeConfig, w *serviceAccountWatcher) error {
+	// Until the initial list completes, a grant or service account may simply not have been
+	// listed yet
+	if !w.status.hasSynced() {
+		return nil
+	}
+
+	// A performance secondary leaves the status of resources, like leases, to the primary
+	if !writesReplicatedStorage(b.System()) {
+		return nil
+	}
+
+	grants := w.databaseAccessGrants()
+	mappings, failed, err := b.databaseAccessMappings(ctx, s, cluster, config, w, grants)
+	if err != nil {
+		return err
+	}
+
+	for _, g := range grants {
+		k8sName := &k8sRoleName{Cluster: cluster, Role: g.spec.Role, Namespace: g.namespace, ServiceAccount: g.spec.ServiceAccount}
+		status, reason, message := metav1.ConditionTrue, reasonGranted, fmt.Sprintf("credentials may be requested from virtual role %s", k8sName.String())
+		if f, ok := failed[g]; ok {
+			status, reason, message = metav1.ConditionFalse, f.reason, f.err.Error()
+		}
+
+		if err := w.setDatabaseAccessReady(g, status, reason, message); err != nil {
+			w.logger.Error("error updating status of DatabaseAccess resource", "namespace", g.namespace, "name", g.obj.GetName(), "error", err)
+		}
+	}
+
+	return b.revokeOrphanedLeases(ctx, s, cluster, config, mappings)
+}
+
+// setDatabaseAccessReady updates the Ready condition of a DatabaseAccess resource, unless it
+// is unchanged
+func (w *serviceAccountWatcher) setDatabaseAccessReady(g *databaseAccessGrant, status metav1.ConditionStatus, reason, message string) error {
+	obj := g.obj.DeepCopy()
+	if !setReadyCondition(obj, status, reason, message, time.Now()) {
+		return nil
+	}
+
+	client := w.databaseAccessClient()
+	if client == nil {
+		return nil
+	}
+
+	_, err := client.Namespace(g.namespace).UpdateStatus(obj, metav1.UpdateOptions{})
+	return err
+}
+
+// setReadyCondition sets the Ready condition in the status of a resource, keeping its last
+// transition time if the status is unchanged. It reports whether the condition changed.
+func setReadyCondition(obj *unstructured.Unstructured, status metav1.ConditionStatus, reason, message string, now time.Time) bool {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+
+	index := -1
+	transitionTime := now.UTC().Format(time.RFC3339)
+	for i, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok || condition["type"] != conditionReady {
+			continue
+		}
+		index = i
+
+		if condition["status"] == string(status) {
+			if condition["reason"] == reason && condition["message"] == message && condition["observedGeneration"] == obj.GetGeneration() {
+				return false
+			}
+			if t, ok := condition["lastTransitionTime"].(string); ok {
+				transitionTime = t
+			}
+		}
+	}
+
+	condition := map[string]interface{}{
+		"type":               conditionReady,
+		"status":             string(status),
+		"reason":             reason,
+		"message":            message,
+		"lastTransitionTime": transitionTime,
+		"observedGeneration": obj.GetGeneration(),
+	}
+	if index == -1 {
+		conditions = append(conditions, condition)
+	} else {
+		conditions[index] = condition
+	}
+
+	if err := unstructured.SetNestedSlice(obj.Object, conditions, "status", "conditions"); err != nil {
+		return false
+	}
+	return true
+}
+
+// databaseAccessClient returns the client of the current reflectors, used to update the
+// status of DatabaseAccess resources
+func (w *serviceAccountWatcher) databaseAccessClient() dynamic.NamespaceableResourceInterface {
+	w.reflectorMtx.Lock()
+	defer w.reflectorMtx.Unlock()
+	return w.grantClient
+}
+
+// databaseAccessListerWatcher lists and watches the DatabaseAccess resources of a namespace,
+// where an empty namespace means all
+func databaseAccessListerWatcher(client, watchClient dynamic.Interface, namespace string) cache.ListerWatcher {
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return client.Resource(databaseAccessResource).Namespace(namespace).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return watchClient.Resource(databaseAccessResource).Namespace(namespace).Watch(options)
+		},
+	}
+}
@@ -0,0 +1,164 @@
+package database
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// eventComponent is reported as the source of the Events recorded by the plugin
+const eventComponent = "vault-database-k8s-controller"
+
+const (
+	eventReasonInvalidAnnotation  = "InvalidAnnotation"
+	eventReasonCredentialsIssued  = "CredentialsIssued"
+	eventReasonCredentialsRevoked = "CredentialsRevoked"
+)
+
+// eventRecorder records Kubernetes Events against service accounts, so that service owners
+// can see what the plugin did with `kubectl describe serviceaccount`. A nil *eventRecorder
+// records nothing, so callers need not check whether events are enabled.
+type eventRecorder struct {
+	logger log.Logger
+
+	mtx sync.Mutex
+	// client is replaced whenever the watcher's credentials change
+	client corev1client.EventsGetter
+	// invalid holds the last invalid annotation error recorded for each service account, so
+	// that an error is recorded once rather than on every sync
+	invalid map[string]string
+}
+
+func newEventRecorder(logger log.Logger) *eventRecorder {
+	return &eventRecorder{
+		logger:  logger,
+		invalid: map[string]string{},
+	}
+}
+
+func (r *eventRecorder) setClient(client corev1client.EventsGetter) {
+	if r == nil {
+		return
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.client = client
+}
+
+// record creates an Event against a service account in the background, so that a slow API
+// server does not hold up issuing credentials
+func (r *eventRecorder) record(namespace, name string, uid types.UID, eventType, reason, message string) {
+	if r == nil {
+		return
+	}
+
+	r.mtx.Lock()
+	client := r.client
+	r.mtx.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	now := metav1.NewTime(time.Now())
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%v.%x", name, now.UnixNano()),
+			Namespace: namespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:       "ServiceAccount",
+			APIVersion: "v1",
+			Namespace:  namespace,
+			Name:       name,
+			UID:        uid,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         v1.EventSource{Component: eventComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	go func() {
+		if _, err := client.Events(namespace).Create(event); err != nil {
+			r.logger.Warn("error recording event on service account", "namespace", namespace, "name", name, "reason", reason, "error", err)
+		}
+	}()
+}
+
+// invalidAnnotation records an Event for a service account whose annotations were rejected,
+// unless the same error has already been recorded
+func (r *eventRecorder) invalidAnnotation(obj interface{}, annotationErr error) {
+	if r == nil {
+		return
+	}
+
+	key, err := keyFunc(obj)
+	if err != nil {
+		return
+	}
+	objMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+
+	message := annotationErr.Error()
+
+	r.mtx.Lock()
+	reported := r.invalid[key] == message
+	r.invalid[key] = message
+	r.mtx.Unlock()
+
+	if reported {
+		return
+	}
+
+	r.record(objMeta.GetNamespace(), objMeta.GetName(), objMeta.GetUID(), v1.EventTypeWarning, eventReasonInvalidAnnotation,
+		fmt.Sprintf("Vault ignored the service account's annotations: %s", message))
+}
+
+// retainInvalid forgets the recorded annotation errors of service accounts which are no
+// longer invalid, so that the error is recorded again if it recurs
+func (r *eventRecorder) retainInvalid(keys map[string]struct{}) {
+	if r == nil {
+		return
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for key := range r.invalid {
+		if _, ok := keys[key]; !ok {
+			delete(r.invalid, key)
+		}
+	}
+}
+
+// recordServiceAccountEvent records an Event against a service account in a cluster, if the
+// cluster is configured to record events
+func (b *databaseBackend) recordServiceAccountEvent(cluster, namespace, name, eventType, reason, message string) {
+	w := b.watcher(cluster)
+	if w == nil || w.events == nil {
+		return
+	}
+
+	var uid types.UID
+	if obj, ok, err := w.cache.GetByKey(namespace + "/" + name); err == nil && ok {
+		if objMeta, err := meta.Accessor(obj); err == nil {
+			uid = objMeta.GetUID()
+		}
+	}
+
+	w.events.record(namespace, name, uid, eventType, reason, message)
+}
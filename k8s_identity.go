@@ -0,0 +1,103 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// kubernetesAuthMountType is the mount type of the kubernetes auth method, whose entity
+	// aliases record the service account a client logged in as
+	kubernetesAuthMountType = "kubernetes"
+
+	aliasMetadataServiceAccountName      = "service_account_name"
+	aliasMetadataServiceAccountNamespace = "service_account_namespace"
+)
+
+// callerServiceAccount is a service account the caller logged in as
+type callerServiceAccount struct {
+	Namespace string
+	Name      string
+}
+
+// callerServiceAccounts returns the service accounts of a cluster the requesting entity has
+// logged in as through the kubernetes auth method. If the cluster's config names an auth mount
+// accessor, only aliases of that mount are considered. Otherwise an alias of any kubernetes auth
+// mount is accepted, which is only safe while the default cluster is the only one configured:
+// a client of another cluster could log in as a service account of the same name.
+func (b *databaseBackend) callerServiceAccounts(ctx context.Context, req *logical.Request, cluster string, config *kubeConfig) ([]callerServiceAccount, error) {
+	if req.EntityID == "" {
+		return nil, errors.New("request has no identity entity; log in with the kubernetes auth method")
+	}
+
+	if config == nil || config.AuthMountAccessor == "" {
+		clusters, err := b.clusters(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		if cluster != "" || len(clusters) > 1 {
+			return nil, fmt.Errorf("auth_mount_accessor must be set on the kubeconfig of cluster %s to identify its service accounts, as more than one cluster is configured", clusterDisplayName(cluster))
+		}
+	}
+
+	entity, err := b.System().EntityInfo(req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	if entity == nil {
+		return nil, fmt.Errorf("identity entity %s not found", req.EntityID)
+	}
+
+	var accounts []callerServiceAccount
+	for _, alias := range entity.Aliases {
+		if alias.MountType != kubernetesAuthMountType {
+			continue
+		}
+		if config != nil && config.AuthMountAccessor != "" && alias.MountAccessor != config.AuthMountAccessor {
+			continue
+		}
+
+		namespace, name := alias.Metadata[aliasMetadataServiceAccountNamespace], alias.Metadata[aliasMetadataServiceAccountName]
+		if namespace == "" || name == "" {
+			continue
+		}
+		accounts = append(accounts, callerServiceAccount{Namespace: namespace, Name: name})
+	}
+
+	if len(accounts) == 0 {
+		return nil, errors.New("identity entity has no kubernetes auth alias with service account metadata")
+	}
+
+	return accounts, nil
+}
+
+// checkServiceAccountBinding refuses the request unless the caller logged in as the service
+// account of the virtual role, when binding is enabled by the role or the cluster's config.
+// A nil response and error means the request may proceed.
+func (b *databaseBackend) checkServiceAccountBinding(ctx context.Context, req *logical.Request, k8sName *k8sRoleName, bindRole bool) (*logical.Response, error) {
+	config, err := b.kubeconfig(ctx, req.Storage, k8sName.Cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bindRole && (config == nil || !config.BindServiceAccount) {
+		return nil, nil
+	}
+
+	accounts, err := b.callerServiceAccounts(ctx, req, k8sName.Cluster, config)
+	if err != nil {
+		return logical.ErrorResponse("credentials for %s are bound to its service account: %s", k8sName.String(), err), logical.ErrPermissionDenied
+	}
+
+	for _, account := range accounts {
+		if account.Namespace == k8sName.Namespace && account.Name == k8sName.ServiceAccount {
+			return nil, nil
+		}
+	}
+
+	return logical.ErrorResponse("credentials for %s are bound to service account %s/%s, but the caller logged in as %s/%s",
+		k8sName.String(), k8sName.Namespace, k8sName.ServiceAccount, accounts[0].Namespace, accounts[0].Name), logical.ErrPermissionDenied
+}
@@ -0,0 +1,245 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/database/dbplugin"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	v1 "k8s.io/api/core/v1"
+)
+
+const serviceAccountLeasePath = "serviceaccount-lease/"
+
+// trackedLeaseRetention is how long a tracked lease is remembered after it would have expired,
+// so that Vault's own revocation of a lease the controller revoked does not try to drop the
+// user a second time
+const trackedLeaseRetention = time.Hour
+
+// serviceAccountLeaseStoragePrefix returns the storage prefix under which leases issued to the
+// service accounts of a cluster are tracked, as <prefix><namespace>/<name>/<username>
+func serviceAccountLeaseStoragePrefix(cluster string) string {
+	if cluster == "" {
+		return serviceAccountLeasePath
+	}
+	return clusterPath + cluster + "/" + serviceAccountLeasePath
+}
+
+// trackedLeaseKey returns the storage key of a lease issued for a virtual role
+func trackedLeaseKey(k8sName *k8sRoleName, username string) string {
+	return serviceAccountLeaseStoragePrefix(k8sName.Cluster) + k8sName.Namespace + "/" + k8sName.ServiceAccount + "/" + username
+}
+
+// trackedLease records credentials issued for a virtual role, so that they can be revoked when
+// the service account they were issued for is deleted or re-annotated
+type trackedLease struct {
+	Role     string `json:"role"`
+	DBName   string `json:"db_name"`
+	Username string `json:"username"`
+	// Keyspaces and DBNameOverride are the keyspaces and db_name annotation of the service
+	// account when the credentials were issued
+	Keyspaces            []string  `json:"keyspaces"`
+	DBNameOverride       string    `json:"db_name_override,omitempty"`
+	RevocationStatements []string  `json:"revocation_statements"`
+	Expiration           time.Time `json:"expiration"`
+	// RevokeAfter is set when the service account is first seen to have lost its mapping, and
+	// cleared if the mapping is restored before it passes
+	RevokeAfter time.Time `json:"revoke_after,omitempty"`
+	// Revoked is set once the controller has revoked the user from the database. The lease
+	// stays in Vault until it expires, but can no longer be renewed.
+	Revoked bool `json:"revoked"`
+}
+
+func (b *databaseBackend) trackedLease(ctx context.Context, s logical.Storage, key string) (*trackedLease, error) {
+	entry, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var lease trackedLease
+	if err := entry.DecodeJSON(&lease); err != nil {
+		return nil, err
+	}
+
+	return &lease, nil
+}
+
+func putTrackedLease(ctx context.Context, s logical.Storage, key string, lease *trackedLease) error {
+	entry, err := logical.StorageEntryJSON(key, lease)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+// trackLease records credentials issued for a virtual role. It reports whether the service
+// account had no other outstanding credentials.
+func (b *databaseBackend) trackLease(ctx context.Context, s logical.Storage, k8sName *k8sRoleName, role *roleEntry, username string, expiration time.Time) (bool, error) {
+	outstanding, err := s.List(ctx, serviceAccountLeaseStoragePrefix(k8sName.Cluster)+k8sName.Namespace+"/"+k8sName.ServiceAccount+"/")
+	if err != nil {
+		return false, err
+	}
+
+	return len(outstanding) == 0, putTrackedLease(ctx, s, trackedLeaseKey(k8sName, username), &trackedLease{
+		Role:                 k8sName.String(),
+		DBName:               role.DBName,
+		Username:             username,
+		Keyspaces:            role.kubernetesMapping.keyspaces(),
+		DBNameOverride:       role.kubernetesMapping.DBName,
+		RevocationStatements: role.Statements.Revocation,
+		Expiration:           expiration,
+	})
+}
+
+// outstandingLeases returns the tracked leases issued to the service accounts of a cluster
+// which have neither expired nor been revoked, keyed by storage key
+func (b *databaseBackend) outstandingLeases(ctx context.Context, s logical.Storage, cluster string) (map[string]*trackedLease, error) {
+	keys, err := logical.CollectKeysWithPrefix(ctx, s, serviceAccountLeaseStoragePrefix(cluster))
+	if err != nil {
+		return nil, err
+	}
+
+	outstanding := map[string]*trackedLease{}
+	now := time.Now()
+	for _, key := range keys {
+		lease, err := b.trackedLease(ctx, s, key)
+		if err != nil {
+			return nil, err
+		}
+		if lease != nil && !lease.Revoked && now.Before(lease.Expiration) {
+			outstanding[key] = lease
+		}
+	}
+
+	return outstanding, nil
+}
+
+// revokeOrphanedLeases revokes the leases of service accounts which are no longer mapped to the
+// keyspaces and database they were issued for, once the configured grace period has passed.
+// mappings is keyed by namespace/name and must contain every annotated service account, or by
+// namespace/name/role if access is granted by DatabaseAccess resources.
+func (b *databaseBackend) revokeOrphanedLeases(ctx context.Context, s logical.Storage, cluster string, config *kubeConfig, mappings map[string]*saCacheObject) error {
+	prefix := serviceAccountLeaseStoragePrefix(cluster)
+
+	keys, err := logical.CollectKeysWithPrefix(ctx, s, prefix)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		subs := strings.SplitN(strings.TrimPrefix(key, prefix), "/", 3)
+		if len(subs) != 3 {
+			continue
+		}
+		serviceAccount := subs[0] + "/" + subs[1]
+
+		lease, err := b.trackedLease(ctx, s, key)
+		if err != nil {
+			return err
+		}
+		if lease == nil {
+			continue
+		}
+
+		if now.After(lease.Expiration.Add(trackedLeaseRetention)) {
+			// Vault has revoked the lease by now
+			if err := s.Delete(ctx, key); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if lease.Revoked {
+			continue
+		}
+
+		mappingKey := serviceAccount
+		if config.grantsFromResources() {
+			// DatabaseAccess resources grant keyspaces to each concrete role separately
+			if k8sName, err := parseKubernetesRoleName(lease.Role); err == nil {
+				mappingKey += "/" + k8sName.Role
+			}
+		}
+
+		mapping := mappings[mappingKey]
+		if mapping != nil && mapping.DBName == lease.DBNameOverride && strutil.EquivalentSlices(mapping.keyspaces(), lease.Keyspaces) {
+			if !lease.RevokeAfter.IsZero() {
+				b.logger.Info("service account mapping restored, leases will not be revoked", "cluster", clusterDisplayName(cluster), "service_account", serviceAccount, "username", lease.Username)
+				lease.RevokeAfter = time.Time{}
+				if err := putTrackedLease(ctx, s, key, lease); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if !config.RevokeLeases {
+			continue
+		}
+
+		if lease.RevokeAfter.IsZero() {
+			lease.RevokeAfter = now.Add(config.RevocationGracePeriod)
+			if err := putTrackedLease(ctx, s, key, lease); err != nil {
+				return err
+			}
+
+			msg := "service account is no longer mapped to the keyspaces or database of its lease, revoking after grace period"
+			if config.RevocationDryRun {
+				msg = "service account is no longer mapped to the keyspaces or database of its lease, would revoke after grace period (dry run)"
+			}
+			b.logger.Info(msg, "cluster", clusterDisplayName(cluster), "service_account", serviceAccount, "username", lease.Username, "revoke_after", lease.RevokeAfter)
+		}
+
+		if now.Before(lease.RevokeAfter) || config.RevocationDryRun {
+			continue
+		}
+
+		if err := b.revokeServiceAccountLease(ctx, s, key, lease); err != nil {
+			b.logger.Error("error revoking lease of service account", "cluster", clusterDisplayName(cluster), "service_account", serviceAccount, "username", lease.Username, "error", err)
+			continue
+		}
+
+		b.logger.Info("revoked lease of service account", "cluster", clusterDisplayName(cluster), "service_account", serviceAccount, "username", lease.Username)
+		b.recordServiceAccountEvent(cluster, subs[0], subs[1], v1.EventTypeWarning, eventReasonCredentialsRevoked,
+			fmt.Sprintf("Vault revoked database user %s of role %s, as the service account is no longer mapped to keyspaces %s", lease.Username, lease.Role, strings.Join(lease.Keyspaces, ",")))
+	}
+
+	return nil
+}
+
+// revokeServiceAccountLease revokes the user of tracked credentials with the revocation
+// statements captured when they were issued, and records that it was revoked
+func (b *databaseBackend) revokeServiceAccountLease(ctx context.Context, s logical.Storage, key string, lease *trackedLease) error {
+	if err := b.revokeTrackedLease(ctx, s, lease); err != nil {
+		return err
+	}
+
+	lease.Revoked = true
+	return putTrackedLease(ctx, s, key, lease)
+}
+
+// revokeTrackedLease runs the revocation statements of a lease against its database
+func (b *databaseBackend) revokeTrackedLease(ctx context.Context, s logical.Storage, lease *trackedLease) error {
+	db, err := b.GetConnection(ctx, s, lease.DBName)
+	if err != nil {
+		return err
+	}
+
+	db.RLock()
+	defer db.RUnlock()
+
+	if err := db.RevokeUser(ctx, dbplugin.Statements{Revocation: lease.RevocationStatements}, lease.Username); err != nil {
+		b.CloseIfShutdown(db, err)
+		return err
+	}
+
+	return nil
+}
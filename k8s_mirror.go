@@ -0,0 +1,283 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"k8s.io/client-go/tools/cache"
+)
+
+// mirrorReconcileInterval is how often the whole durable mapping of a cluster is reconciled
+// against the cache, as a safety net for any change the event handlers missed
+const mirrorReconcileInterval = 10 * time.Minute
+
+// serviceAccountMirror keeps the durable service account mapping of a cluster up to date as
+// the watcher's cache changes. Each changed service account is persisted in the background,
+// and storage is only written when its mapping actually changes.
+type serviceAccountMirror struct {
+	b       *databaseBackend
+	storage logical.Storage
+	cluster string
+	config  *kubeConfig
+	cache   cache.Store
+	// namespaces is the namespace cache, if namespace annotations are used as defaults
+	namespaces cache.Store
+
+	// mtx serialises writes by the event handlers with the periodic reconcile
+	mtx sync.Mutex
+
+	// reconcileMtx guards the reconcile schedule separately from mtx, so that requesting a
+	// reconcile does not wait for one in progress. lastReconcile is when the mapping was last
+	// reconciled in full. requests counts the reconciles requested, for instance when the
+	// reflector replaces the cache, as changes may have been missed while it relisted, and
+	// reconciledRequests how many of them the last reconcile covered.
+	reconcileMtx       sync.Mutex
+	lastReconcile      time.Time
+	requests           uint64
+	reconciledRequests uint64
+
+	pendingMtx sync.Mutex
+	pending    map[string]struct{}
+	signal     chan struct{}
+}
+
+func newServiceAccountMirror(b *databaseBackend, s logical.Storage, cluster string, config *kubeConfig, store cache.Store) *serviceAccountMirror {
+	return &serviceAccountMirror{
+		b:       b,
+		storage: s,
+		cluster: cluster,
+		config:  config,
+		cache:   store,
+		pending: map[string]struct{}{},
+		signal:  make(chan struct{}, 1),
+	}
+}
+
+// enqueue schedules a service account to be persisted
+func (m *serviceAccountMirror) enqueue(obj interface{}) {
+	key, err := keyFunc(obj)
+	if err != nil {
+		return
+	}
+
+	m.pendingMtx.Lock()
+	m.pending[key] = struct{}{}
+	m.pendingMtx.Unlock()
+
+	select {
+	case m.signal <- struct{}{}:
+	default:
+	}
+}
+
+// enqueueNamespace schedules every cached service account in a namespace to be persisted
+func (m *serviceAccountMirror) enqueueNamespace(namespace string) {
+	m.pendingMtx.Lock()
+	for _, key := range m.cache.ListKeys() {
+		if strings.HasPrefix(key, namespace+"/") {
+			m.pending[key] = struct{}{}
+		}
+	}
+	m.pendingMtx.Unlock()
+
+	select {
+	case m.signal <- struct{}{}:
+	default:
+	}
+}
+
+// requestReconcile makes the next sync reconcile the whole mapping
+func (m *serviceAccountMirror) requestReconcile() {
+	m.reconcileMtx.Lock()
+	defer m.reconcileMtx.Unlock()
+	m.requests++
+}
+
+// reconcileDue reports whether the whole mapping should be reconciled
+func (m *serviceAccountMirror) reconcileDue() bool {
+	if m == nil {
+		return true
+	}
+
+	m.reconcileMtx.Lock()
+	defer m.reconcileMtx.Unlock()
+	return m.requests != m.reconciledRequests || time.Since(m.lastReconcile) >= mirrorReconcileInterval
+}
+
+// reconcileRequests returns how many reconciles have been requested, to be passed to
+// reconciled once a reconcile starting now completes
+func (m *serviceAccountMirror) reconcileRequests() uint64 {
+	m.reconcileMtx.Lock()
+	defer m.reconcileMtx.Unlock()
+	return m.requests
+}
+
+// reconciled records that the whole mapping was reconciled, covering the given number of
+// requests. Any requested while it ran are still due.
+func (m *serviceAccountMirror) reconciled(requests uint64) {
+	m.reconcileMtx.Lock()
+	defer m.reconcileMtx.Unlock()
+	m.lastReconcile = time.Now()
+	m.reconciledRequests = requests
+}
+
+// run persists enqueued service accounts until stopCh is closed
+func (m *serviceAccountMirror) run(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-m.signal:
+		}
+
+		m.pendingMtx.Lock()
+		pending := m.pending
+		m.pending = map[string]struct{}{}
+		m.pendingMtx.Unlock()
+
+		for key := range pending {
+			if err := m.persist(context.Background(), key); err != nil {
+				m.b.logger.Error("error persisting service account mapping", "cluster", clusterDisplayName(m.cluster), "service_account", key, "error", err)
+			}
+		}
+	}
+}
+
+// persist writes the current mapping of a service account to storage, or removes it if the
+// service account no longer exists or is no longer validly annotated
+func (m *serviceAccountMirror) persist(ctx context.Context, key string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var mapping *saCacheObject
+	obj, exists, err := m.cache.GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		mapping, err = m.b.getServiceAccountMapping(m.config, m.namespaces, obj)
+		if err != nil {
+			m.b.logger.Error("error getting annotation for object", "service_account", key, "error", err)
+			mapping = nil
+		}
+	}
+	if mapping != nil && mapping.Keyspace == "" {
+		mapping = nil
+	}
+
+	storageKey := m.b.mappingStoragePrefix(m.cluster, m.config) + key
+	if mapping == nil {
+		_, err = removeServiceAccountMapping(ctx, m.storage, storageKey, m.config.tombstoneGracePeriod())
+		return err
+	}
+
+	_, err = putServiceAccountMapping(ctx, m.storage, storageKey, mapping)
+	return err
+}
+
+// putServiceAccountMapping stores the mapping of a service account at key. Storage is only
+// written if the stored mapping differs, and the return value reports whether it was.
+func putServiceAccountMapping(ctx context.Context, s logical.Storage, key string, mapping *saCacheObject) (bool, error) {
+	entry, err := s.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	if entry != nil {
+		var existing saCacheObject
+		if err := entry.DecodeJSON(&existing); err == nil && reflect.DeepEqual(&existing, mapping) {
+			return false, nil
+		}
+	}
+
+	entry, err = logical.StorageEntryJSON(key, mapping)
+	if err != nil {
+		return false, err
+	}
+
+	return true, s.Put(ctx, entry)
+}
+
+// tombstoneResult describes what removeServiceAccountMapping did with a stored mapping
+type tombstoneResult int
+
+const (
+	tombstoneNone tombstoneResult = iota
+	// tombstoneCreated means the mapping was marked as deleted, but kept
+	tombstoneCreated
+	// tombstoneDeleted means the mapping was removed from storage
+	tombstoneDeleted
+)
+
+// removeServiceAccountMapping marks the stored mapping at key as deleted. The mapping is kept,
+// and still served to service accounts which are missing from the cache, until it has been
+// marked for the grace period, after which it is deleted.
+func removeServiceAccountMapping(ctx context.Context, s logical.Storage, key string, grace time.Duration) (tombstoneResult, error) {
+	entry, err := s.Get(ctx, key)
+	if err != nil || entry == nil {
+		return tombstoneNone, err
+	}
+
+	var mapping saCacheObject
+	if err := entry.DecodeJSON(&mapping); err != nil {
+		return tombstoneNone, err
+	}
+
+	now := time.Now()
+	switch {
+	case grace <= 0, mapping.DeletedAt != nil && now.Sub(*mapping.DeletedAt) >= grace:
+		return tombstoneDeleted, s.Delete(ctx, key)
+	case mapping.DeletedAt != nil:
+		return tombstoneNone, nil
+	}
+
+	mapping.DeletedAt = &now
+	entry, err = logical.StorageEntryJSON(key, &mapping)
+	if err != nil {
+		return tombstoneNone, err
+	}
+
+	return tombstoneCreated, s.Put(ctx, entry)
+}
+
+// mirrorStore wraps the reflector's store to persist the service accounts it changes
+type mirrorStore struct {
+	cache.Store
+	mirror *serviceAccountMirror
+}
+
+func (s *mirrorStore) Add(obj interface{}) error {
+	if err := s.Store.Add(obj); err != nil {
+		return err
+	}
+	s.mirror.enqueue(obj)
+	return nil
+}
+
+func (s *mirrorStore) Update(obj interface{}) error {
+	if err := s.Store.Update(obj); err != nil {
+		return err
+	}
+	s.mirror.enqueue(obj)
+	return nil
+}
+
+func (s *mirrorStore) Delete(obj interface{}) error {
+	if err := s.Store.Delete(obj); err != nil {
+		return err
+	}
+	s.mirror.enqueue(obj)
+	return nil
+}
+
+func (s *mirrorStore) Replace(list []interface{}, resourceVersion string) error {
+	if err := s.Store.Replace(list, resourceVersion); err != nil {
+		return err
+	}
+	s.mirror.requestReconcile()
+	return nil
+}
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// mappingLevelServiceAccount and mappingLevelNamespace report whether a value of a mapping
+	// was read from the service account or from its namespace
+	mappingLevelServiceAccount = "serviceaccount"
+	mappingLevelNamespace      = "namespace"
+
+	// namespacesReflectorKey identifies the reflector watching namespaces among those watching
+	// service accounts, which are keyed by namespace. It cannot be a namespace name.
+	namespacesReflectorKey = "/namespaces"
+)
+
+// annotationWithDefault returns the value of an annotation of a service account, or else of
+// its namespace, along with the level it was read from. Levels other than the service account
+// are reported, so that stored mappings are unchanged for service accounts annotated directly.
+func annotationWithDefault(key string, annotations, namespaceAnnotations map[string]string) (string, string) {
+	if value := annotations[key]; value != "" {
+		return value, ""
+	}
+	if value := namespaceAnnotations[key]; value != "" {
+		return value, mappingLevelNamespace
+	}
+	return "", ""
+}
+
+// mappingLevel reports the level a value was read from, for API responses
+func mappingLevel(level string) string {
+	if level == "" {
+		return mappingLevelServiceAccount
+	}
+	return level
+}
+
+// getServiceAccountMapping is getObjectAnnotations, falling back to the annotations of the
+// service account's namespace in namespaces, if namespaces are watched
+func (b *databaseBackend) getServiceAccountMapping(config *kubeConfig, namespaces cache.Store, obj interface{}) (*saCacheObject, error) {
+	return b.getObjectMapping(config, obj, namespaceOf(namespaces, obj))
+}
+
+// namespaceOf returns the cached namespace of an object, or nil if namespaces is nil or the
+// namespace is not cached
+func namespaceOf(namespaces cache.Store, obj interface{}) interface{} {
+	if namespaces == nil {
+		return nil
+	}
+
+	objMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return nil
+	}
+
+	namespace, exists, err := namespaces.GetByKey(objMeta.GetNamespace())
+	if err != nil || !exists {
+		return nil
+	}
+	return namespace
+}
+
+// namespaceEventStore wraps the namespace cache to persist the mappings of the service
+// accounts in a namespace whose annotations change
+type namespaceEventStore struct {
+	cache.Store
+	mirror *serviceAccountMirror
+}
+
+func (s *namespaceEventStore) Add(obj interface{}) error {
+	if err := s.Store.Add(obj); err != nil {
+		return err
+	}
+	s.enqueue(obj)
+	return nil
+}
+
+func (s *namespaceEventStore) Update(obj interface{}) error {
+	if err := s.Store.Update(obj); err != nil {
+		return err
+	}
+	s.enqueue(obj)
+	return nil
+}
+
+func (s *namespaceEventStore) Delete(obj interface{}) error {
+	if err := s.Store.Delete(obj); err != nil {
+		return err
+	}
+	s.enqueue(obj)
+	return nil
+}
+
+func (s *namespaceEventStore) Replace(list []interface{}, resourceVersion string) error {
+	if err := s.Store.Replace(list, resourceVersion); err != nil {
+		return err
+	}
+	s.mirror.requestReconcile()
+	return nil
+}
+
+func (s *namespaceEventStore) enqueue(obj interface{}) {
+	if objMeta, err := meta.Accessor(obj); err == nil {
+		s.mirror.enqueueNamespace(objMeta.GetName())
+	}
+}
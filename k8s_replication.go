@@ -0,0 +1,51 @@
+package database
+
+import (
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// localMappingPath prefixes the durable mapping a performance secondary keeps of its own
+// cluster. It is listed under LocalStorage, so it is not replicated from the primary.
+const localMappingPath = "local/"
+
+// writesReplicatedStorage reports whether this node may write the replicated service account
+// mapping, leases and provisioned roles. It applies the same rules as initQueue: the node must
+// not be a DR secondary or performance standby, and must be on the primary unless the mount
+// is local.
+func writesReplicatedStorage(sys logical.SystemView) bool {
+	replicationState := sys.ReplicationState()
+	return (sys.LocalMount() || !replicationState.HasState(consts.ReplicationPerformanceSecondary)) &&
+		!replicationState.HasState(consts.ReplicationDRSecondary) &&
+		!replicationState.HasState(consts.ReplicationPerformanceStandby)
+}
+
+// usesLocalMapping reports whether this node reads the mapping of a cluster from local
+// storage, which is the case on performance secondaries when the config enables local_mapping
+func usesLocalMapping(sys logical.SystemView, config *kubeConfig) bool {
+	return config != nil && config.LocalMapping &&
+		!sys.LocalMount() && sys.ReplicationState().HasState(consts.ReplicationPerformanceSecondary)
+}
+
+// watchesServiceAccounts reports whether this node should run a watcher for a cluster. Nodes
+// which can write neither the replicated nor a local mapping rely on the mapping in storage.
+func (b *databaseBackend) watchesServiceAccounts(config *kubeConfig) bool {
+	sys := b.System()
+	if writesReplicatedStorage(sys) {
+		return true
+	}
+
+	replicationState := sys.ReplicationState()
+	return usesLocalMapping(sys, config) &&
+		!replicationState.HasState(consts.ReplicationDRSecondary) &&
+		!replicationState.HasState(consts.ReplicationPerformanceStandby)
+}
+
+// mappingStoragePrefix returns the storage prefix holding the durable mapping of a cluster
+// as used by this node
+func (b *databaseBackend) mappingStoragePrefix(cluster string, config *kubeConfig) string {
+	if usesLocalMapping(b.System(), config) {
+		return localMappingPath + serviceAccountStoragePrefix(cluster)
+	}
+	return serviceAccountStoragePrefix(cluster)
+}
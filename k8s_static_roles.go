@@ -0,0 +1,383 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/database/dbplugin"
+	"github.com/hashicorp/vault/sdk/database/helper/dbutil"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hashicorp/vault/sdk/queue"
+)
+
+// provisionStaticRoles ensures that every annotated service account in the cluster has a static
+// role provisioned from each template static role, and removes provisioned static roles whose
+// service account or template no longer exists. mappings is keyed by namespace/name. Unless
+// forced, no role is removed if more than the kubeconfig's max_deletions_per_sync would be.
+//
+// Provisioned roles are stored at static-role/k8s_<template>_<service-account>_<namespace>, so that
+// they are read and rotated exactly like any other static role.
+func (b *databaseBackend) provisionStaticRoles(ctx context.Context, s logical.Storage, cluster string, config *kubeConfig, mappings map[string]*saCacheObject, force bool) error {
+	templates, err := b.staticRoleTemplates(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	provisioned, err := b.provisionedStaticRoles(ctx, s, cluster)
+	if err != nil {
+		return err
+	}
+
+	for templateName, template := range templates {
+		for key, mapping := range mappings {
+			subs := strings.SplitN(key, "/", 2)
+			k8sName := &k8sRoleName{
+				Cluster:        cluster,
+				Role:           templateName,
+				Namespace:      subs[0],
+				ServiceAccount: subs[1],
+			}
+			name := k8sName.String()
+			delete(provisioned, name)
+
+			role, err := renderStaticRole(k8sName, template, config, mapping)
+			if err != nil {
+				b.logger.Error("error provisioning static role", "role", name, "error", err)
+				continue
+			}
+
+			if err := b.provisionStaticRole(ctx, s, name, role); err != nil {
+				b.logger.Error("error provisioning static role", "role", name, "error", err)
+			}
+		}
+	}
+
+	// anything left over belongs to a service account or template which no longer exists
+	if maxDeletions := config.maxDeletionsPerSync(); !force && maxDeletions > 0 && len(provisioned) > maxDeletions {
+		return fmt.Errorf("refusing to remove %d provisioned static roles, more than max_deletions_per_sync (%d); check the kubeconfig points at the right cluster, then force a reconcile", len(provisioned), maxDeletions)
+	}
+
+	for name := range provisioned {
+		b.logger.Info("removing static role provisioned for a service account that is no longer annotated", "role", name)
+		if err := b.deprovisionStaticRole(ctx, s, name); err != nil {
+			b.logger.Error("error removing provisioned static role", "role", name, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// renderStaticRole returns the static role a template provisions for a service account
+func renderStaticRole(k8sName *k8sRoleName, template *roleEntry, config *kubeConfig, mapping *saCacheObject) (*roleEntry, error) {
+	if err := checkAnnotationPattern(k8sName, template, config, mapping); err != nil {
+		return nil, err
+	}
+
+	role := &roleEntry{
+		DBName:             template.DBName,
+		BindServiceAccount: template.BindServiceAccount,
+		StaticAccount: &staticAccount{
+			RotationPeriod:    template.StaticAccount.RotationPeriod,
+			KubernetesMapping: mapping,
+		},
+	}
+
+	if mapping.DBName != "" {
+		if err := template.checkDBNameOverride(k8sName, mapping.DBName); err != nil {
+			return nil, err
+		}
+		role.DBName = mapping.DBName
+	}
+
+	// The username is interpolated once rather than per keyspace, which role writes ensure
+	// it does not depend on
+	if strings.Contains(template.StaticAccount.Username, "{{annotation}}") {
+		return nil, fmt.Errorf("the username of the template refers to {{annotation}}")
+	}
+	username, err := interpolateStatement(template.StaticAccount.Username, templateVariables(k8sName, mapping))
+	if err != nil {
+		return nil, err
+	}
+	role.StaticAccount.Username = username
+
+	for _, statements := range []struct {
+		template []string
+		role     *[]string
+	}{
+		{template.Statements.Creation, &role.Statements.Creation},
+		{template.Statements.Revocation, &role.Statements.Revocation},
+		{template.Statements.Rotation, &role.Statements.Rotation},
+	} {
+		*statements.role, err = expandStatements(statements.template, k8sName, mapping)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return role, nil
+}
+
+// provisionStaticRole stores a static role rendered from a template for a service account.
+// A new user is created if the role's database or username changed, replacing the user of the
+// previous version of the role, and otherwise the password of the existing user is rotated
+// with the role's new statements. A change of binding alone is stored without rotating.
+func (b *databaseBackend) provisionStaticRole(ctx context.Context, s logical.Storage, name string, role *roleEntry) error {
+	lock := locksutil.LockForKey(b.roleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	existing, err := b.StaticRole(ctx, s, name)
+	if err != nil {
+		return err
+	}
+	if existing != nil && (existing.StaticAccount == nil || existing.StaticAccount.KubernetesMapping == nil) {
+		return fmt.Errorf("static role %s exists and was not provisioned from a template", name)
+	}
+
+	if existing != nil && sameProvisionedRole(existing, role) {
+		if existing.BindServiceAccount == role.BindServiceAccount {
+			return nil
+		}
+
+		existing.BindServiceAccount = role.BindServiceAccount
+		entry, err := logical.StorageEntryJSON(databaseStaticRolePath+name, existing)
+		if err != nil {
+			return err
+		}
+		return s.Put(ctx, entry)
+	}
+
+	createUser := existing == nil || existing.DBName != role.DBName || existing.StaticAccount.Username != role.StaticAccount.Username
+	if !createUser {
+		role.StaticAccount.Password = existing.StaticAccount.Password
+		role.StaticAccount.LastVaultRotation = existing.StaticAccount.LastVaultRotation
+	}
+
+	b.logger.Info("provisioning static role for service account", "role", name, "username", role.StaticAccount.Username, "create_user", createUser)
+
+	// The previous version of the role, if any, is removed from the queue before rotating
+	b.popFromRotationQueueByKey(name)
+
+	resp, err := b.setStaticAccount(ctx, s, &setStaticAccountInput{
+		RoleName:   name,
+		Role:       role,
+		CreateUser: createUser,
+	})
+	if err != nil {
+		if createUser {
+			// Storage still holds the previous version of the role, if any, so the WAL can't be
+			// replayed against it; the user is created again at the next sync instead
+			if resp != nil && resp.WALID != "" {
+				if err := framework.DeleteWAL(ctx, s, resp.WALID); err != nil {
+					b.logger.Warn("error deleting WAL of provisioned static role", "role", name, "error", err)
+				}
+			}
+			if existing != nil {
+				b.pushItem(&queue.Item{
+					Key:      name,
+					Priority: existing.StaticAccount.LastVaultRotation.Add(existing.StaticAccount.RotationPeriod).Unix(),
+				})
+			}
+		} else if resp != nil && resp.WALID != "" {
+			// retry promptly from the WAL rather than waiting for the next sync
+			b.pushItem(&queue.Item{Key: name, Value: resp.WALID})
+		}
+		return err
+	}
+
+	if createUser && existing != nil {
+		if err := b.revokeStaticUser(ctx, s, existing); err != nil {
+			b.logger.Error("error revoking user of previous version of provisioned static role", "role", name, "username", existing.StaticAccount.Username, "error", err)
+		}
+	}
+
+	return b.pushItem(&queue.Item{
+		Key:      name,
+		Priority: resp.RotationTime.Add(role.StaticAccount.RotationPeriod).Unix(),
+	})
+}
+
+// sameProvisionedRole reports whether a stored provisioned static role was rendered from the
+// same template and mapping as role, ignoring its credentials and binding
+func sameProvisionedRole(existing, role *roleEntry) bool {
+	return existing.DBName == role.DBName &&
+		existing.StaticAccount.Username == role.StaticAccount.Username &&
+		existing.StaticAccount.RotationPeriod == role.StaticAccount.RotationPeriod &&
+		reflect.DeepEqual(existing.StaticAccount.KubernetesMapping, role.StaticAccount.KubernetesMapping) &&
+		equalStatements(existing.Statements.Creation, role.Statements.Creation) &&
+		equalStatements(existing.Statements.Revocation, role.Statements.Revocation) &&
+		equalStatements(existing.Statements.Rotation, role.Statements.Rotation)
+}
+
+// equalStatements compares two lists of statements, where nil and empty lists are equal
+func equalStatements(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// setProvisionedCredentials sets the password of the user of a provisioned static account by
+// running its rotation statements, or creates the user with its creation statements. The
+// statements are run through the plugin's CreateUser with the account's username and password
+// already interpolated, as plugins such as Cassandra do not implement SetCredentials. If
+// creation fails part way, plugins which roll back do so with the revocation statements.
+func setProvisionedCredentials(ctx context.Context, db dbplugin.Database, statements dbplugin.Statements, user dbplugin.StaticUserConfig, create bool) error {
+	values := map[string]string{
+		"name":     user.Username,
+		"username": user.Username,
+		"password": user.Password,
+	}
+	interpolate := func(statements []string) []string {
+		var result []string
+		for _, statement := range statements {
+			result = append(result, dbutil.QueryHelper(statement, values))
+		}
+		return result
+	}
+
+	run := dbplugin.Statements{Creation: interpolate(statements.Rotation)}
+	if create {
+		run = dbplugin.Statements{
+			Creation: interpolate(statements.Creation),
+			Rollback: interpolate(statements.Revocation),
+		}
+	}
+	if len(run.Creation) == 0 {
+		return fmt.Errorf("static account %s has no statements to run", user.Username)
+	}
+
+	_, _, err := db.CreateUser(ctx, run, dbplugin.UsernameConfig{DisplayName: user.Username, RoleName: user.Username}, time.Time{})
+	return err
+}
+
+// staticRoleTemplates returns all static roles marked as templates, keyed by name
+func (b *databaseBackend) staticRoleTemplates(ctx context.Context, s logical.Storage) (map[string]*roleEntry, error) {
+	names, err := s.List(ctx, databaseStaticRolePath)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := map[string]*roleEntry{}
+	for _, name := range names {
+		if isKubernetesRoleName(name) {
+			continue
+		}
+
+		role, err := b.StaticRole(ctx, s, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if role != nil && role.StaticAccount != nil && role.StaticAccount.KubernetesTemplate {
+			templates[name] = role
+		}
+	}
+
+	return templates, nil
+}
+
+// provisionedStaticRoles returns the static roles which were provisioned from a template for
+// service accounts in the cluster, keyed by name
+func (b *databaseBackend) provisionedStaticRoles(ctx context.Context, s logical.Storage, cluster string) (map[string]*roleEntry, error) {
+	names, err := s.List(ctx, databaseStaticRolePath)
+	if err != nil {
+		return nil, err
+	}
+
+	provisioned := map[string]*roleEntry{}
+	for _, name := range names {
+		if !isKubernetesRoleName(name) {
+			continue
+		}
+
+		k8sName, err := parseKubernetesRoleName(name)
+		if err != nil || k8sName.Cluster != cluster {
+			continue
+		}
+
+		role, err := b.StaticRole(ctx, s, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if role != nil && role.StaticAccount != nil && role.StaticAccount.KubernetesMapping != nil {
+			provisioned[name] = role
+		}
+	}
+
+	return provisioned, nil
+}
+
+// deprovisionStaticRole revokes the database user of a provisioned static role, and then
+// removes the role from storage and the rotation queue. The role is kept if the user could not
+// be revoked, so that it is retried at the next sync.
+func (b *databaseBackend) deprovisionStaticRole(ctx context.Context, s logical.Storage, name string) error {
+	lock := locksutil.LockForKey(b.roleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := b.StaticRole(ctx, s, name)
+	if err != nil || role == nil {
+		return err
+	}
+
+	if err := b.revokeStaticUser(ctx, s, role); err != nil {
+		return err
+	}
+
+	b.popFromRotationQueueByKey(name)
+
+	return s.Delete(ctx, databaseStaticRolePath+name)
+}
+
+// revokeStaticUser runs the revocation statements of a provisioned static role against its
+// database
+func (b *databaseBackend) revokeStaticUser(ctx context.Context, s logical.Storage, role *roleEntry) error {
+	db, err := b.GetConnection(ctx, s, role.DBName)
+	if err != nil {
+		return err
+	}
+
+	db.RLock()
+	defer db.RUnlock()
+
+	if err := db.RevokeUser(ctx, dbplugin.Statements{Revocation: role.Statements.Revocation}, role.StaticAccount.Username); err != nil {
+		b.CloseIfShutdown(db, err)
+		return err
+	}
+
+	return nil
+}
+
+// clusterGrantingFromResources returns the name of a cluster whose virtual roles are resolved
+// from DatabaseAccess resources, if any. Such clusters have no annotated service accounts to
+// provision static roles for, so templates are not allowed alongside them.
+func (b *databaseBackend) clusterGrantingFromResources(ctx context.Context, s logical.Storage) (string, bool, error) {
+	clusters, err := b.clusters(ctx, s)
+	if err != nil {
+		return "", false, err
+	}
+
+	for _, cluster := range clusters {
+		config, err := b.kubeconfig(ctx, s, cluster)
+		if err != nil {
+			return "", false, err
+		}
+		if config != nil && config.grantsFromResources() {
+			return cluster, true, nil
+		}
+	}
+
+	return "", false, nil
+}
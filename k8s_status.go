@@ -0,0 +1,193 @@
+package database
+
+import (
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watcherStatus records the health of a service account watcher, so that it can be
+// reported without digging through the reflector's logs.
+type watcherStatus struct {
+	sync.RWMutex
+
+	// synced is set once the reflectors have completed their initial list of every
+	// namespace in unsynced
+	synced   bool
+	unsynced map[string]struct{}
+	// lastEvent is the time the cache last changed due to a watch event
+	lastEvent time.Time
+	// lastRelist is the time a reflector last replaced its part of the cache with a list
+	lastRelist time.Time
+	// lastError is the last error returned by a list or watch call against the API, and
+	// lastSuccess the time of the last call which succeeded. The error is current only if it
+	// is more recent than the last success.
+	lastError     error
+	lastErrorTime time.Time
+	lastSuccess   time.Time
+	// lastSync and lastSyncError describe the last run of syncServiceAccounts
+	lastSync      time.Time
+	lastSyncError error
+	// rejected holds the values of each service account which did not match the kubeconfig's
+	// annotation_pattern at the last sync
+	rejected map[string][]string
+}
+
+func (s *watcherStatus) recordEvent() {
+	s.Lock()
+	defer s.Unlock()
+	s.lastEvent = time.Now()
+}
+
+// expectNamespaces makes the status synced only once each of the namespaces has been listed
+func (s *watcherStatus) expectNamespaces(namespaces []string) {
+	s.Lock()
+	defer s.Unlock()
+	s.unsynced = map[string]struct{}{}
+	for _, namespace := range namespaces {
+		s.unsynced[namespace] = struct{}{}
+	}
+}
+
+func (s *watcherStatus) recordReplace(namespace string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.unsynced, namespace)
+	s.synced = len(s.unsynced) == 0
+	s.lastRelist = time.Now()
+}
+
+// recordCall records the outcome of a list or watch call against the API
+func (s *watcherStatus) recordCall(err error) {
+	s.Lock()
+	defer s.Unlock()
+	if err == nil {
+		s.lastSuccess = time.Now()
+		return
+	}
+	s.lastError = err
+	s.lastErrorTime = time.Now()
+}
+
+func (s *watcherStatus) recordSync(err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastSync = time.Now()
+	s.lastSyncError = err
+}
+
+func (s *watcherStatus) recordRejected(rejected map[string][]string) {
+	s.Lock()
+	defer s.Unlock()
+	s.rejected = rejected
+}
+
+// hasSynced reports whether the reflector has completed its initial list
+func (s *watcherStatus) hasSynced() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.synced
+}
+
+// statusStore wraps the reflector's store to record when it is populated and updated
+type statusStore struct {
+	cache.Store
+	status    *watcherStatus
+	namespace string
+}
+
+func (s *statusStore) Add(obj interface{}) error {
+	s.status.recordEvent()
+	return s.Store.Add(obj)
+}
+
+func (s *statusStore) Update(obj interface{}) error {
+	s.status.recordEvent()
+	return s.Store.Update(obj)
+}
+
+func (s *statusStore) Delete(obj interface{}) error {
+	s.status.recordEvent()
+	return s.Store.Delete(obj)
+}
+
+func (s *statusStore) Replace(list []interface{}, resourceVersion string) error {
+	if err := s.Store.Replace(list, resourceVersion); err != nil {
+		return err
+	}
+	s.status.recordReplace(s.namespace)
+	return nil
+}
+
+// statusListerWatcher wraps the reflector's ListerWatcher to record API errors, which the
+// reflector otherwise only logs
+type statusListerWatcher struct {
+	cache.ListerWatcher
+	status *watcherStatus
+}
+
+func (lw *statusListerWatcher) List(options metav1.ListOptions) (runtime.Object, error) {
+	obj, err := lw.ListerWatcher.List(options)
+	lw.status.recordCall(err)
+	return obj, err
+}
+
+func (lw *statusListerWatcher) Watch(options metav1.ListOptions) (watch.Interface, error) {
+	w, err := lw.ListerWatcher.Watch(options)
+	lw.status.recordCall(err)
+	return w, err
+}
+
+// statusData renders the status of a watcher for an API response
+func (w *serviceAccountWatcher) statusData() map[string]interface{} {
+	versions := w.lastSyncResourceVersions()
+
+	w.status.RLock()
+	defer w.status.RUnlock()
+
+	data := map[string]interface{}{
+		"watching":              true,
+		"synced":                w.status.synced,
+		"last_resource_version": versions[metav1.NamespaceAll],
+		"object_count":          len(w.cache.ListKeys()),
+		"last_event_time":       formatStatusTime(w.status.lastEvent),
+		"last_relist_time":      formatStatusTime(w.status.lastRelist),
+		"last_error":            formatStatusError(w.status.lastError),
+		"last_error_time":       formatStatusTime(w.status.lastErrorTime),
+		"last_success_time":     formatStatusTime(w.status.lastSuccess),
+		"last_sync_time":        formatStatusTime(w.status.lastSync),
+		"last_sync_error":       formatStatusError(w.status.lastSyncError),
+		"rejected_values":       w.status.rejected,
+	}
+	if w.status.rejected == nil {
+		data["rejected_values"] = map[string][]string{}
+	}
+
+	if w.grants != nil {
+		data["grant_count"] = len(w.grants.ListKeys())
+	}
+
+	if _, ok := versions[metav1.NamespaceAll]; !ok {
+		data["last_resource_versions"] = versions
+	}
+
+	return data
+}
+
+func formatStatusTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func formatStatusError(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,116 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	authorizationv1client "k8s.io/client-go/kubernetes/typed/authorization/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// watchVerbs are the verbs a reflector needs on the resource it watches
+var watchVerbs = []string{"list", "watch"}
+
+// verifyServiceAccountAccess checks that the API server can be reached with a cluster's
+// credentials, by listing a single service account, and that the credentials may list and
+// watch service accounts in each of the namespaces, where an empty namespace means all
+func verifyServiceAccountAccess(serviceAccounts corev1client.ServiceAccountsGetter, reviews authorizationv1client.SelfSubjectAccessReviewsGetter, namespaces []string) error {
+	if _, err := serviceAccounts.ServiceAccounts(namespaces[0]).List(metav1.ListOptions{Limit: 1}); err != nil {
+		return fmt.Errorf("error listing service accounts: %s", err)
+	}
+
+	for _, namespace := range namespaces {
+		denied, err := deniedVerbs(reviews, authorizationv1.ResourceAttributes{Namespace: namespace, Resource: "serviceaccounts"}, watchVerbs)
+		if err != nil {
+			return err
+		}
+
+		if len(denied) == 0 {
+			continue
+		}
+		if namespace == metav1.NamespaceAll {
+			return fmt.Errorf("credentials are not allowed to %s serviceaccounts in all namespaces", strings.Join(denied, " or "))
+		}
+		return fmt.Errorf("credentials are not allowed to %s serviceaccounts in namespace %s", strings.Join(denied, " or "), namespace)
+	}
+
+	return nil
+}
+
+// verifyNamespaceAccess checks that the credentials may list and watch namespaces
+func verifyNamespaceAccess(reviews authorizationv1client.SelfSubjectAccessReviewsGetter) error {
+	denied, err := deniedVerbs(reviews, authorizationv1.ResourceAttributes{Resource: "namespaces"}, watchVerbs)
+	if err != nil {
+		return err
+	}
+	if len(denied) > 0 {
+		return fmt.Errorf("credentials are not allowed to %s namespaces", strings.Join(denied, " or "))
+	}
+	return nil
+}
+
+// verifyDatabaseAccessAccess checks that DatabaseAccess resources can be listed, which fails
+// if their CustomResourceDefinition is not installed, and that the credentials may list and
+// watch them and update their status in each of the namespaces, where an empty namespace
+// means all
+func verifyDatabaseAccessAccess(grants dynamic.NamespaceableResourceInterface, reviews authorizationv1client.SelfSubjectAccessReviewsGetter, namespaces []string) error {
+	if _, err := grants.Namespace(namespaces[0]).List(metav1.ListOptions{Limit: 1}); err != nil {
+		return fmt.Errorf("error listing DatabaseAccess resources, check their CustomResourceDefinition is installed: %s", err)
+	}
+
+	for _, namespace := range namespaces {
+		attributes := authorizationv1.ResourceAttributes{
+			Namespace: namespace,
+			Group:     databaseAccessResource.Group,
+			Resource:  databaseAccessResource.Resource,
+		}
+		denied, err := deniedVerbs(reviews, attributes, watchVerbs)
+		if err != nil {
+			return err
+		}
+
+		attributes.Subresource = "status"
+		deniedStatus, err := deniedVerbs(reviews, attributes, []string{"update"})
+		if err != nil {
+			return err
+		}
+		for _, verb := range deniedStatus {
+			denied = append(denied, verb+" status of")
+		}
+
+		if len(denied) == 0 {
+			continue
+		}
+		if namespace == metav1.NamespaceAll {
+			return fmt.Errorf("credentials are not allowed to %s databaseaccesses in all namespaces", strings.Join(denied, " or "))
+		}
+		return fmt.Errorf("credentials are not allowed to %s databaseaccesses in namespace %s", strings.Join(denied, " or "), namespace)
+	}
+
+	return nil
+}
+
+// deniedVerbs returns the verbs which the credentials may not use on a resource, described by
+// attributes without a verb
+func deniedVerbs(reviews authorizationv1client.SelfSubjectAccessReviewsGetter, attributes authorizationv1.ResourceAttributes, verbs []string) ([]string, error) {
+	var denied []string
+	for _, verb := range verbs {
+		attributes := attributes
+		attributes.Verb = verb
+		review, err := reviews.SelfSubjectAccessReviews().Create(&authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &attributes,
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error reviewing access to %s: %s", attributes.Resource, err)
+		}
+		if !review.Status.Allowed {
+			denied = append(denied, verb)
+		}
+	}
+	return denied, nil
+}
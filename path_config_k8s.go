@@ -3,25 +3,88 @@ package database
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 const kubeconfigPath string = "kubeconfig"
 
+// kubeconfigVerifyTimeout bounds each request made to verify a config when it is written
+const kubeconfigVerifyTimeout = 10 * time.Second
+
+const (
+	// defaultTombstoneGracePeriod and defaultMaxDeletionsPerSync protect the stored mapping
+	// against a kubeconfig pointed at the wrong cluster, unless the config sets otherwise
+	defaultTombstoneGracePeriod = time.Hour
+	defaultMaxDeletionsPerSync  = 100
+
+	// defaultResyncPeriod is how often the reflectors relist, unless the config sets otherwise
+	defaultResyncPeriod = time.Hour
+)
+
+const (
+	// inClusterTokenPath and inClusterCACertPath are where Kubernetes mounts the
+	// credentials of the pod's service account
+	inClusterTokenPath  = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCACertPath = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// kubeconfigStorageKey returns the storage key holding the config for a cluster. The
+// default, unnamed cluster is stored at kubeconfig and named clusters at kubeconfig/<name>.
+func kubeconfigStorageKey(cluster string) string {
+	if cluster == "" {
+		return kubeconfigPath
+	}
+	return kubeconfigPath + "/" + cluster
+}
+
+// reservedClusterNames are the subpaths of the default cluster's kubeconfig, which a named
+// cluster's kubeconfig/<name> would be indistinguishable from
+var reservedClusterNames = []string{"status", "reconcile"}
+
+// validateClusterName returns an error if a cluster may not be given the name
+func validateClusterName(cluster string) error {
+	if strings.Contains(cluster, "_") {
+		// underscores separate the components of virtual role names
+		return errors.New("cluster name must not contain underscores")
+	}
+	for _, reserved := range reservedClusterNames {
+		if cluster == reserved {
+			return fmt.Errorf("cluster name %q is reserved", cluster)
+		}
+	}
+	return nil
+}
+
 // pathKubeconfig returns configuration for Kubernetes
 func pathKubeconfig(b *databaseBackend) []*framework.Path {
 	return []*framework.Path{{
-		Pattern: "kubeconfig$",
+		Pattern: "kubeconfig(/" + framework.GenericNameRegex("name") + ")?$",
 		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of the Kubernetes cluster. If omitted, configures the default cluster.",
+			},
 			"kubernetes_host": {
 				Type:        framework.TypeString,
 				Description: "Host must be a host string, a host:port pair, or a URL to the base of the Kubernetes API server.",
 				DisplayAttrs: &framework.DisplayAttributes{
 					Name: "Kubernetes Host",
 				},
-				Required: true,
 			},
 
 			"kubernetes_ca_cert": {
@@ -37,7 +100,27 @@ func pathKubeconfig(b *databaseBackend) []*framework.Path {
 				DisplayAttrs: &framework.DisplayAttributes{
 					Name: "JWT",
 				},
-				Required: true,
+			},
+			"token_path": {
+				Type:        framework.TypeString,
+				Description: "Path to a file containing the JWT used to access the K8S API. The file is re-read periodically, so that rotated tokens are picked up. Mutually exclusive with jwt.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Token Path",
+				},
+			},
+			"ca_cert_path": {
+				Type:        framework.TypeString,
+				Description: "Path to a file containing the PEM encoded CA cert for the K8S API. The file is re-read periodically. Mutually exclusive with kubernetes_ca_cert.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "CA Certificate Path",
+				},
+			},
+			"in_cluster": {
+				Type:        framework.TypeBool,
+				Description: "Use the credentials of the pod Vault is running in. The host defaults to the in-cluster API server, and the token and CA cert paths to those of the pod's service account.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "In Cluster",
+				},
 			},
 			"keyspace_annotation": {
 				Type:        framework.TypeString,
@@ -55,21 +138,194 @@ func pathKubeconfig(b *databaseBackend) []*framework.Path {
 				},
 				Default: "monzo.com/cluster",
 			},
+			"annotation_pattern": {
+				Type:        framework.TypeString,
+				Description: "Regular expression which keyspaces and template variable values must match in full to be interpolated into statements, unless the concrete role sets its own annotation_pattern.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Annotation Pattern",
+				},
+				Default: defaultAnnotationPattern,
+			},
+			"annotation_variables": {
+				Type:        framework.TypeKVPairs,
+				Description: `Map of template variable names to service account annotation keys, given as a map or a list of name=key pairs. The value of each annotation is interpolated into statements as {{annotations.<name>}}.`,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Annotation Variables",
+				},
+			},
+			"label_variables": {
+				Type:        framework.TypeKVPairs,
+				Description: `Map of template variable names to service account label keys, given as a map or a list of name=key pairs. The value of each label is interpolated into statements as {{labels.<name>}}.`,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Label Variables",
+				},
+			},
+			"record_events": {
+				Type:        framework.TypeBool,
+				Description: "Record Kubernetes Events on service accounts when their annotations are invalid, when credentials are first issued to them and when the controller revokes their credentials. Requires permission to create events.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Record Events",
+				},
+			},
+			"bind_service_account": {
+				Type:        framework.TypeBool,
+				Description: "Only issue credentials for a service account to clients which logged in as that service account through the kubernetes auth method, for every concrete role.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Bind Service Account",
+				},
+			},
+			"auth_mount_accessor": {
+				Type:        framework.TypeString,
+				Description: "Accessor of the kubernetes auth mount clients of this cluster log in with. Required to identify the caller's service account, for k8s-self-creds and bind_service_account, unless the default cluster is the only one configured, in which case an alias of any kubernetes auth mount is accepted.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Auth Mount Accessor",
+				},
+			},
+			"revoke_leases": {
+				Type:        framework.TypeBool,
+				Description: "Revoke credentials issued to a service account once it is deleted or its keyspace annotation changes, rather than waiting for their leases to expire.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Revoke Leases",
+				},
+			},
+			"revocation_grace_period": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How long a service account must remain deleted or re-annotated before its credentials are revoked.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Revocation Grace Period",
+				},
+				Default: 300,
+			},
+			"revocation_dry_run": {
+				Type:        framework.TypeBool,
+				Description: "Log the credentials that would be revoked under revoke_leases, without revoking them.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Revocation Dry Run",
+				},
+			},
+			"resync_period": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How often the reflectors relist the cluster, replacing their cache and reconciling the stored mapping against it. 0 disables relists.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Resync Period",
+				},
+				Default: int(defaultResyncPeriod / time.Second),
+			},
+			"qps": {
+				Type:        framework.TypeInt,
+				Description: "Maximum queries per second the Kubernetes client sends to the API server. 0 uses the client default of 5.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "QPS",
+				},
+			},
+			"burst": {
+				Type:        framework.TypeInt,
+				Description: "Maximum burst of queries the Kubernetes client sends above qps. 0 uses the client default of 10.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Burst",
+				},
+			},
+			"request_timeout": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Timeout of requests to the API server, other than watches. 0 means no timeout.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Request Timeout",
+				},
+			},
+			"label_selector": {
+				Type:        framework.TypeString,
+				Description: "Only watch service accounts matching this label selector, eg vault.monzo.com/managed=true.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Label Selector",
+				},
+			},
+			"field_selector": {
+				Type:        framework.TypeString,
+				Description: "Only watch service accounts matching this field selector, eg metadata.namespace!=kube-system.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Field Selector",
+				},
+			},
+			"namespaces": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Namespaces to watch service accounts in. If empty, all namespaces are watched.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Namespaces",
+				},
+			},
+			"namespace_defaults": {
+				Type:        framework.TypeBool,
+				Description: "Also watch namespaces, and use the keyspace and db_name annotations of a namespace for the service accounts in it which have none. Requires permission to list and watch namespaces.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Namespace Defaults",
+				},
+			},
+			"grant_source": {
+				Type:        framework.TypeString,
+				Description: `Where service accounts are granted keyspaces: "annotations" reads the keyspace and db_name annotations of service accounts, and "database_access" watches DatabaseAccess custom resources instead, writing their status. Requires permission to list and watch databaseaccesses, and to update databaseaccesses/status.`,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Grant Source",
+				},
+				Default: grantSourceAnnotations,
+			},
+			"skip_verify": {
+				Type:        framework.TypeBool,
+				Description: "Save the config without checking that the Kubernetes API can be reached and that the credentials may list and watch service accounts.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Skip Verify",
+				},
+			},
+			"purge_mappings": {
+				Type:        framework.TypeBool,
+				Description: "On delete, also remove the service account mapping persisted in storage, revoke the leases issued to the cluster's service accounts, and remove the static roles provisioned for them. Otherwise virtual roles keep resolving from the mapping.",
+			},
+			"local_mapping": {
+				Type:        framework.TypeBool,
+				Description: "On performance secondaries, watch this cluster and keep the service account mapping in storage local to the secondary, rather than reading the mapping replicated from the primary. Usually combined with in_cluster, so that each secondary watches the cluster it runs in.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Local Mapping",
+				},
+			},
+			"tombstone_grace_period": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How long the stored mapping of a service account is kept after the service account is deleted or unannotated. A tombstoned mapping is reported under serviceaccounts/, but no longer issues credentials. 0 deletes the mapping immediately.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Tombstone Grace Period",
+				},
+				Default: int(defaultTombstoneGracePeriod / time.Second),
+			},
+			"max_deletions_per_sync": {
+				Type:        framework.TypeInt,
+				Description: "Maximum number of stored service account mappings a sync may delete. A sync which would delete more deletes none, until a reconcile is forced. 0 disables the limit.",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Max Deletions Per Sync",
+				},
+				Default: defaultMaxDeletionsPerSync,
+			},
 		},
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.UpdateOperation: b.pathKubeconfigWrite(),
 			logical.CreateOperation: b.pathKubeconfigWrite(),
 			logical.ReadOperation:   b.pathKubeconfigRead(),
+			logical.DeleteOperation: b.pathKubeconfigDelete(),
 		},
 
 		HelpSynopsis:    confHelpSyn,
 		HelpDescription: confHelpDesc,
+	}, {
+		Pattern: "kubeconfig/?$",
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathKubeconfigList(),
+		},
+
+		HelpSynopsis:    confListHelpSyn,
+		HelpDescription: confListHelpDesc,
 	}}
 }
 
-// kubeconfig takes a storage object and returns a kubeConfig object
-func (b *databaseBackend) kubeconfig(ctx context.Context, s logical.Storage) (*kubeConfig, error) {
-	raw, err := s.Get(ctx, kubeconfigPath)
+// kubeconfig takes a storage object and returns the kubeConfig object of a cluster
+func (b *databaseBackend) kubeconfig(ctx context.Context, s logical.Storage, cluster string) (*kubeConfig, error) {
+	raw, err := s.Get(ctx, kubeconfigStorageKey(cluster))
 	if err != nil {
 		return nil, err
 	}
@@ -85,10 +341,54 @@ func (b *databaseBackend) kubeconfig(ctx context.Context, s logical.Storage) (*k
 	return conf, nil
 }
 
+// clusters returns the names of all configured clusters, where the default cluster
+// is represented by the empty string
+func (b *databaseBackend) clusters(ctx context.Context, s logical.Storage) ([]string, error) {
+	var clusters []string
+
+	entry, err := s.Get(ctx, kubeconfigPath)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		clusters = append(clusters, "")
+	}
+
+	named, err := s.List(ctx, kubeconfigPath+"/")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range named {
+		if strings.HasSuffix(name, "/") {
+			continue
+		}
+		clusters = append(clusters, name)
+	}
+
+	return clusters, nil
+}
+
+// pathKubeconfigList lists the named clusters
+func (b *databaseBackend) pathKubeconfigList() framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		entries, err := req.Storage.List(ctx, kubeconfigPath+"/")
+		if err != nil {
+			return nil, err
+		}
+
+		return logical.ListResponse(entries), nil
+	}
+}
+
 // pathConfigWrite handles create and update commands to the config
 func (b *databaseBackend) pathKubeconfigRead() framework.OperationFunc {
 	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-		if config, err := b.kubeconfig(ctx, req.Storage); err != nil {
+		cluster := data.Get("name").(string)
+		if err := validateClusterName(cluster); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+
+		if config, err := b.kubeconfig(ctx, req.Storage, cluster); err != nil {
 			return nil, err
 		} else if config == nil {
 			return nil, nil
@@ -98,8 +398,37 @@ func (b *databaseBackend) pathKubeconfigRead() framework.OperationFunc {
 				Data: map[string]interface{}{
 					"kubernetes_host":     config.Host,
 					"kubernetes_ca_cert":  config.CACert,
+					"token_path":          config.TokenPath,
+					"ca_cert_path":        config.CACertPath,
+					"in_cluster":          config.InCluster,
 					"keyspace_annotation": config.KeyspaceAnnotation,
 					"db_name_annotation":  config.DBNameAnnotation,
+					"annotation_pattern":  config.annotationPattern(),
+
+					"annotation_variables": config.AnnotationVariables,
+					"label_variables":      config.LabelVariables,
+
+					"record_events":           config.RecordEvents,
+					"bind_service_account":    config.BindServiceAccount,
+					"auth_mount_accessor":     config.AuthMountAccessor,
+					"revoke_leases":           config.RevokeLeases,
+					"revocation_grace_period": config.RevocationGracePeriod.Seconds(),
+					"revocation_dry_run":      config.RevocationDryRun,
+
+					"resync_period":   config.resyncPeriod().Seconds(),
+					"qps":             config.QPS,
+					"burst":           config.Burst,
+					"request_timeout": config.RequestTimeout.Seconds(),
+					"label_selector":  config.LabelSelector,
+					"field_selector":  config.FieldSelector,
+					"namespaces":      config.Namespaces,
+
+					"namespace_defaults": config.NamespaceDefaults,
+					"grant_source":       config.grantSource(),
+
+					"local_mapping":          config.LocalMapping,
+					"tombstone_grace_period": config.tombstoneGracePeriod().Seconds(),
+					"max_deletions_per_sync": config.maxDeletionsPerSync(),
 				},
 			}
 
@@ -108,54 +437,284 @@ func (b *databaseBackend) pathKubeconfigRead() framework.OperationFunc {
 	}
 }
 
+// pathKubeconfigDelete removes the config of a cluster and stops watching it
+func (b *databaseBackend) pathKubeconfigDelete() framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		cluster := data.Get("name").(string)
+		if err := validateClusterName(cluster); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+
+		config, err := b.kubeconfig(ctx, req.Storage, cluster)
+		if err != nil {
+			return nil, err
+		}
+		if config == nil {
+			return nil, nil
+		}
+
+		purge := data.Get("purge_mappings").(bool)
+
+		b.stopWatcher(cluster)
+
+		if purge {
+			if err := b.purgeCluster(ctx, req.Storage, cluster, config); err != nil {
+				// the config is kept, so that the delete can be retried
+				if err := b.startWatcher(req.Storage, cluster, config); err != nil {
+					b.logger.Error("error restarting watcher", "cluster", clusterDisplayName(cluster), "error", err)
+				}
+				return nil, err
+			}
+		}
+
+		if err := req.Storage.Delete(ctx, kubeconfigStorageKey(cluster)); err != nil {
+			return nil, err
+		}
+
+		return nil, nil
+	}
+}
+
+// purgeCluster revokes the users of the leases issued to the service accounts of a cluster and
+// of the static roles provisioned for them, and then removes its stored service account mapping
+func (b *databaseBackend) purgeCluster(ctx context.Context, s logical.Storage, cluster string, config *kubeConfig) error {
+	outstanding, err := b.outstandingLeases(ctx, s, cluster)
+	if err != nil {
+		return err
+	}
+	for key, lease := range outstanding {
+		if err := b.revokeServiceAccountLease(ctx, s, key, lease); err != nil {
+			return fmt.Errorf("error revoking lease of database user %s: %v", lease.Username, err)
+		}
+	}
+	// Revoked leases are kept until Vault revokes them in turn, which forgets them without
+	// dropping the user again. Expired ones need no revoking.
+	keys, err := logical.CollectKeysWithPrefix(ctx, s, serviceAccountLeaseStoragePrefix(cluster))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		lease, err := b.trackedLease(ctx, s, key)
+		if err != nil {
+			return err
+		}
+		if lease != nil && lease.Revoked {
+			continue
+		}
+		if err := s.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	b.logger.Info("revoked leases of service accounts", "cluster", clusterDisplayName(cluster), "count", len(outstanding))
+
+	provisioned, err := b.provisionedStaticRoles(ctx, s, cluster)
+	if err != nil {
+		return err
+	}
+	for name := range provisioned {
+		if err := b.deprovisionStaticRole(ctx, s, name); err != nil {
+			return fmt.Errorf("error removing provisioned static role %s: %v", name, err)
+		}
+	}
+	b.logger.Info("removed provisioned static roles", "cluster", clusterDisplayName(cluster), "count", len(provisioned))
+
+	prefix := b.mappingStoragePrefix(cluster, config)
+	keys, err = logical.CollectKeysWithPrefix(ctx, s, prefix)
+	if err != nil {
+		return err
+	}
+	if err := deleteWithPrefix(ctx, s, prefix); err != nil {
+		return err
+	}
+	b.logger.Info("purged service account mappings", "cluster", clusterDisplayName(cluster), "count", len(keys))
+
+	return nil
+}
+
+// deleteWithPrefix deletes every storage entry under a prefix
+func deleteWithPrefix(ctx context.Context, s logical.Storage, prefix string) error {
+	keys, err := logical.CollectKeysWithPrefix(ctx, s, prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // pathConfigWrite handles create and update commands to the config
 func (b *databaseBackend) pathKubeconfigWrite() framework.OperationFunc {
 	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		cluster := data.Get("name").(string)
+		if err := validateClusterName(cluster); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+
+		inCluster := data.Get("in_cluster").(bool)
+
 		host := data.Get("kubernetes_host").(string)
-		if host == "" {
+		if host == "" && !inCluster {
 			return logical.ErrorResponse("no host provided"), nil
 		}
 
 		caCert := data.Get("kubernetes_ca_cert").(string)
-		if len(caCert) == 0 {
-			return logical.ErrorResponse("kubernetes_ca_cert must be set"), nil
+		caCertPath := data.Get("ca_cert_path").(string)
+		if len(caCert) != 0 && caCertPath != "" {
+			return logical.ErrorResponse("only one of kubernetes_ca_cert and ca_cert_path may be set"), nil
+		}
+		if len(caCert) == 0 && caCertPath == "" && !inCluster {
+			return logical.ErrorResponse("kubernetes_ca_cert or ca_cert_path must be set"), nil
 		}
 
 		jwt := data.Get("jwt").(string)
-		if jwt == "" {
-			return logical.ErrorResponse("jwt must be set"), nil
+		tokenPath := data.Get("token_path").(string)
+		if jwt != "" && tokenPath != "" {
+			return logical.ErrorResponse("only one of jwt and token_path may be set"), nil
 		}
+		if jwt == "" && tokenPath == "" && !inCluster {
+			return logical.ErrorResponse("jwt or token_path must be set"), nil
+		}
+
 		keyspaceAnnotationKey := data.Get("keyspace_annotation").(string)
 		dbNameAnnotationKey := data.Get("db_name_annotation").(string)
+		tombstoneGracePeriod := time.Duration(data.Get("tombstone_grace_period").(int)) * time.Second
+		maxDeletionsPerSync := data.Get("max_deletions_per_sync").(int)
+		resyncPeriod := time.Duration(data.Get("resync_period").(int)) * time.Second
 		config := &kubeConfig{
 			Host:               host,
 			CACert:             caCert,
 			JWT:                jwt,
+			TokenPath:          tokenPath,
+			CACertPath:         caCertPath,
+			InCluster:          inCluster,
 			KeyspaceAnnotation: keyspaceAnnotationKey,
 			DBNameAnnotation:   dbNameAnnotationKey,
+			AnnotationPattern:  data.Get("annotation_pattern").(string),
+
+			AnnotationVariables: data.Get("annotation_variables").(map[string]string),
+			LabelVariables:      data.Get("label_variables").(map[string]string),
+
+			RecordEvents:          data.Get("record_events").(bool),
+			BindServiceAccount:    data.Get("bind_service_account").(bool),
+			AuthMountAccessor:     data.Get("auth_mount_accessor").(string),
+			RevokeLeases:          data.Get("revoke_leases").(bool),
+			RevocationGracePeriod: time.Duration(data.Get("revocation_grace_period").(int)) * time.Second,
+			RevocationDryRun:      data.Get("revocation_dry_run").(bool),
+
+			ResyncPeriod:   &resyncPeriod,
+			QPS:            data.Get("qps").(int),
+			Burst:          data.Get("burst").(int),
+			RequestTimeout: time.Duration(data.Get("request_timeout").(int)) * time.Second,
+			LabelSelector:  data.Get("label_selector").(string),
+			FieldSelector:  data.Get("field_selector").(string),
+			Namespaces:     data.Get("namespaces").([]string),
+
+			NamespaceDefaults: data.Get("namespace_defaults").(bool),
+			GrantSource:       data.Get("grant_source").(string),
+
+			LocalMapping:         data.Get("local_mapping").(bool),
+			TombstoneGracePeriod: &tombstoneGracePeriod,
+			MaxDeletionsPerSync:  &maxDeletionsPerSync,
 		}
 
-		entry, err := logical.StorageEntryJSON(kubeconfigPath, config)
-		if err != nil {
-			return nil, err
+		if config.RevocationGracePeriod < 0 {
+			return logical.ErrorResponse("revocation_grace_period must not be negative"), nil
+		}
+		if resyncPeriod < 0 || config.RequestTimeout < 0 {
+			return logical.ErrorResponse("resync_period and request_timeout must not be negative"), nil
+		}
+		if config.QPS < 0 || config.Burst < 0 {
+			return logical.ErrorResponse("qps and burst must not be negative"), nil
+		}
+		if _, err := labels.Parse(config.LabelSelector); err != nil {
+			return logical.ErrorResponse("invalid label_selector: %s", err), nil
+		}
+		if _, err := fields.ParseSelector(config.FieldSelector); err != nil {
+			return logical.ErrorResponse("invalid field_selector: %s", err), nil
+		}
+		if config.GrantSource != grantSourceAnnotations && config.GrantSource != grantSourceDatabaseAccess {
+			return logical.ErrorResponse("grant_source must be %q or %q", grantSourceAnnotations, grantSourceDatabaseAccess), nil
+		}
+		if config.grantsFromResources() {
+			templates, err := b.staticRoleTemplates(ctx, req.Storage)
+			if err != nil {
+				return nil, err
+			}
+			if len(templates) > 0 {
+				return logical.ErrorResponse("grant_source %q does not provision static role templates; delete the kubernetes_template static roles first", grantSourceDatabaseAccess), nil
+			}
+		}
+		if tombstoneGracePeriod < 0 {
+			return logical.ErrorResponse("tombstone_grace_period must not be negative"), nil
+		}
+		if maxDeletionsPerSync < 0 {
+			return logical.ErrorResponse("max_deletions_per_sync must not be negative"), nil
 		}
 
-		if err := req.Storage.Put(ctx, entry); err != nil {
-			return nil, err
+		if _, err := compileAnnotationPattern(config.AnnotationPattern); err != nil {
+			return logical.ErrorResponse("invalid annotation_pattern: %s", err), nil
 		}
 
-		b.stopMtx.Lock()
-		defer b.stopMtx.Unlock()
+		for name := range config.AnnotationVariables {
+			if !variableNameRegex.MatchString(name) {
+				return logical.ErrorResponse("annotation variable name %q did not match regex %s", name, variableNameRegexStr), nil
+			}
+		}
+		for name := range config.LabelVariables {
+			if !variableNameRegex.MatchString(name) {
+				return logical.ErrorResponse("label variable name %q did not match regex %s", name, variableNameRegexStr), nil
+			}
+		}
+
+		// make sure any files can actually be read before saving
+		creds, err := config.credentials()
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
 
-		if b.stopWatch != nil {
-			b.stopWatch()
+		if !data.Get("skip_verify").(bool) {
+			restConfig := config.tuneRestConfig(creds.restConfig())
+			if restConfig.Timeout == 0 {
+				restConfig.Timeout = kubeconfigVerifyTimeout
+			}
+			client, err := clientset.NewForConfig(restConfig)
+			if err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+			if err := verifyServiceAccountAccess(client.CoreV1(), client.AuthorizationV1(), config.watchedNamespaces()); err != nil {
+				return logical.ErrorResponse("error verifying kubeconfig: %s", err), nil
+			}
+			if config.NamespaceDefaults {
+				if err := verifyNamespaceAccess(client.AuthorizationV1()); err != nil {
+					return logical.ErrorResponse("error verifying kubeconfig: %s", err), nil
+				}
+			}
+			if config.grantsFromResources() {
+				grantClient, err := dynamic.NewForConfig(restConfig)
+				if err != nil {
+					return logical.ErrorResponse(err.Error()), nil
+				}
+				if err := verifyDatabaseAccessAccess(grantClient.Resource(databaseAccessResource), client.AuthorizationV1(), config.watchedNamespaces()); err != nil {
+					return logical.ErrorResponse("error verifying kubeconfig: %s", err), nil
+				}
+			}
 		}
 
-		stop, err := b.watchServiceAccounts(config)
+		entry, err := logical.StorageEntryJSON(kubeconfigStorageKey(cluster), config)
 		if err != nil {
 			return nil, err
 		}
-		b.stopWatch = stop
+
+		if err := req.Storage.Put(ctx, entry); err != nil {
+			return nil, err
+		}
+
+		if err := b.startWatcher(req.Storage, cluster, config); err != nil {
+			return nil, err
+		}
 
 		return nil, nil
 	}
@@ -170,14 +729,218 @@ type kubeConfig struct {
 	CACert string `json:"ca_cert"`
 	// JWT is the bearer to use during the API call
 	JWT string `json:"jwt"`
+	// TokenPath is a file to read the bearer from, instead of JWT
+	TokenPath string `json:"token_path"`
+	// CACertPath is a file to read the CA Cert from, instead of CACert
+	CACertPath string `json:"ca_cert_path"`
+	// InCluster defaults the host, token and CA Cert to those available to a pod
+	InCluster bool `json:"in_cluster"`
 	// KeyspaceAnnotation is the annotation key to look for in service accounts to interpolate into statements
 	KeyspaceAnnotation string `json:"keyspace_annotation"`
 	// DBNameAnnotation is the annotation key to look for in service accounts to override database name for a role
 	DBNameAnnotation string `json:"db_name_annotation"`
+	// AnnotationPattern is the pattern values must match to be interpolated into statements,
+	// unless the concrete role sets its own
+	AnnotationPattern string `json:"annotation_pattern,omitempty"`
+	// AnnotationVariables maps template variable names to the annotation keys they are read from
+	AnnotationVariables map[string]string `json:"annotation_variables,omitempty"`
+	// LabelVariables maps template variable names to the label keys they are read from
+	LabelVariables map[string]string `json:"label_variables,omitempty"`
+	// RecordEvents records Kubernetes Events against service accounts
+	RecordEvents bool `json:"record_events"`
+	// BindServiceAccount restricts credentials to clients which logged in as their service account
+	BindServiceAccount bool `json:"bind_service_account"`
+	// AuthMountAccessor selects the kubernetes auth mount whose aliases identify callers
+	AuthMountAccessor string `json:"auth_mount_accessor"`
+	// RevokeLeases revokes credentials issued to a service account when it is deleted or re-annotated
+	RevokeLeases bool `json:"revoke_leases"`
+	// RevocationGracePeriod is how long a service account must stay unmapped before revocation
+	RevocationGracePeriod time.Duration `json:"revocation_grace_period"`
+	// RevocationDryRun logs revocations instead of performing them
+	RevocationDryRun bool `json:"revocation_dry_run"`
+	// ResyncPeriod is how often the reflectors relist. Like MaxDeletionsPerSync, it is a pointer
+	// so that configs stored before it was added get the default.
+	ResyncPeriod *time.Duration `json:"resync_period,omitempty"`
+	// QPS and Burst rate limit the Kubernetes client, where 0 uses the client's defaults
+	QPS   int `json:"qps,omitempty"`
+	Burst int `json:"burst,omitempty"`
+	// RequestTimeout bounds requests to the API server other than watches
+	RequestTimeout time.Duration `json:"request_timeout,omitempty"`
+	// LabelSelector and FieldSelector restrict the service accounts which are watched
+	LabelSelector string `json:"label_selector,omitempty"`
+	FieldSelector string `json:"field_selector,omitempty"`
+	// Namespaces restricts the namespaces which are watched, where empty means all
+	Namespaces []string `json:"namespaces,omitempty"`
+	// NamespaceDefaults falls back to the annotations of a service account's namespace
+	NamespaceDefaults bool `json:"namespace_defaults,omitempty"`
+	// GrantSource is grantSourceDatabaseAccess if DatabaseAccess resources grant service
+	// accounts their keyspaces, and otherwise their annotations do
+	GrantSource string `json:"grant_source,omitempty"`
+	// LocalMapping keeps a mapping of the cluster in local storage on performance secondaries
+	LocalMapping bool `json:"local_mapping"`
+	// TombstoneGracePeriod is how long the stored mapping of a removed service account is kept
+	TombstoneGracePeriod *time.Duration `json:"tombstone_grace_period,omitempty"`
+	// MaxDeletionsPerSync caps how many stored mappings a sync may delete, unless forced. Both
+	// are pointers, so that configs stored before they were added get the defaults rather than
+	// their disabled zero values.
+	MaxDeletionsPerSync *int `json:"max_deletions_per_sync,omitempty"`
+}
+
+// kubeCredentials are the resolved values used to call into the kubernetes API.
+// When they are read from files, they can change over the lifetime of a watcher.
+type kubeCredentials struct {
+	Host   string
+	Token  string
+	CACert string
+}
+
+// watchedNamespaces returns the namespaces to run a reflector for, where a single empty
+// namespace watches every namespace
+func (c *kubeConfig) watchedNamespaces() []string {
+	if len(c.Namespaces) == 0 {
+		return []string{metav1.NamespaceAll}
+	}
+	return c.Namespaces
+}
+
+// annotationPattern returns the pattern values must match to be interpolated into the
+// statements of a concrete role which sets none, where a nil config uses the default
+func (c *kubeConfig) annotationPattern() string {
+	if c == nil || c.AnnotationPattern == "" {
+		return defaultAnnotationPattern
+	}
+	return c.AnnotationPattern
+}
+
+// resyncPeriod returns how often the reflectors relist, for configs stored before
+// resync_period was added
+func (c *kubeConfig) resyncPeriod() time.Duration {
+	if c.ResyncPeriod == nil {
+		return defaultResyncPeriod
+	}
+	return *c.ResyncPeriod
+}
+
+// tombstoneGracePeriod returns how long the stored mapping of a removed service account is
+// kept, for configs stored before tombstone_grace_period was added
+func (c *kubeConfig) tombstoneGracePeriod() time.Duration {
+	if c.TombstoneGracePeriod == nil {
+		return defaultTombstoneGracePeriod
+	}
+	return *c.TombstoneGracePeriod
+}
+
+// maxDeletionsPerSync returns how many stored mappings a sync may delete, for configs stored
+// before max_deletions_per_sync was added
+func (c *kubeConfig) maxDeletionsPerSync() int {
+	if c.MaxDeletionsPerSync == nil {
+		return defaultMaxDeletionsPerSync
+	}
+	return *c.MaxDeletionsPerSync
+}
+
+// grantSource returns where service accounts are granted keyspaces, for configs stored
+// before grant_source was added
+func (c *kubeConfig) grantSource() string {
+	if c.GrantSource == "" {
+		return grantSourceAnnotations
+	}
+	return c.GrantSource
+}
+
+// tuneRestConfig applies the configured rate limits and timeout to a client config
+func (c *kubeConfig) tuneRestConfig(config *rest.Config) *rest.Config {
+	config.QPS = float32(c.QPS)
+	config.Burst = c.Burst
+	config.Timeout = c.RequestTimeout
+	return config
+}
+
+// restConfig returns the config of a client authenticating with the credentials
+func (c *kubeCredentials) restConfig() *rest.Config {
+	return &rest.Config{
+		Host:        c.Host,
+		BearerToken: c.Token,
+		TLSClientConfig: rest.TLSClientConfig{
+			CAData: []byte(c.CACert),
+		},
+	}
+}
+
+// reloadsCredentials reports whether any credentials are read from files, and so
+// should be periodically refreshed
+func (c *kubeConfig) reloadsCredentials() bool {
+	return c.InCluster || c.TokenPath != "" || c.CACertPath != ""
+}
+
+// credentials resolves the host, token and CA cert of the config, reading any files
+func (c *kubeConfig) credentials() (*kubeCredentials, error) {
+	creds := &kubeCredentials{
+		Host:   c.Host,
+		Token:  c.JWT,
+		CACert: c.CACert,
+	}
+
+	tokenPath, caCertPath := c.TokenPath, c.CACertPath
+
+	if c.InCluster {
+		if creds.Host == "" {
+			host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+			if host == "" || port == "" {
+				return nil, fmt.Errorf("in_cluster is set but KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not, so kubernetes_host must be provided")
+			}
+			creds.Host = "https://" + net.JoinHostPort(host, port)
+		}
+		if creds.Token == "" && tokenPath == "" {
+			tokenPath = inClusterTokenPath
+		}
+		if creds.CACert == "" && caCertPath == "" {
+			caCertPath = inClusterCACertPath
+		}
+	}
+
+	if tokenPath != "" {
+		token, err := ioutil.ReadFile(tokenPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading token file: %v", err)
+		}
+		creds.Token = strings.TrimSpace(string(token))
+	}
+
+	if caCertPath != "" {
+		caCert, err := ioutil.ReadFile(caCertPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA cert file: %v", err)
+		}
+		creds.CACert = string(caCert)
+	}
+
+	return creds, nil
 }
 
 const confHelpSyn = `Configures the JWT Public Key and Kubernetes API information.`
 const confHelpDesc = `
 The k8s-controller database reads service account objects via the k8s API.
 This endpoint configures the necessary information to access the Kubernetes API.
+
+Credentials can be given directly with "jwt" and "kubernetes_ca_cert", or read
+from files with "token_path" and "ca_cert_path". Files are re-read every minute
+and the client rebuilt if they change, so projected service account tokens can
+be rotated. Setting "in_cluster" uses the service account of the pod Vault runs in.
+
+Writing to "kubeconfig" configures the default cluster. Additional clusters can
+be configured at "kubeconfig/<name>", and their service accounts are referred
+to with virtual role names of the form "k8s-<name>_<role>_<service-account>_<namespace>".
+
+Deleting a config stops watching the cluster. Its service account mapping stays in
+storage, and virtual roles keep resolving from it, unless "purge_mappings" is set.
+Purging also revokes the database users of the leases issued to the cluster's
+service accounts, and removes the static roles provisioned for them after
+revoking their users.
+`
+
+const confListHelpSyn = `Lists the named Kubernetes clusters.`
+const confListHelpDesc = `
+Lists the names of the Kubernetes clusters configured at "kubeconfig/<name>".
+The default cluster configured at "kubeconfig" is not included.
 `
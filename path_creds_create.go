@@ -3,12 +3,16 @@ package database
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/database/dbplugin"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/logical"
+	v1 "k8s.io/api/core/v1"
 )
 
 func pathCredsCreate(b *databaseBackend) []*framework.Path {
@@ -61,95 +65,160 @@ func (b *databaseBackend) pathCredsCreateRead() framework.OperationFunc {
 			return logical.ErrorResponse(fmt.Sprintf("unknown role: %s", name)), nil
 		}
 
-		dbConfig, err := b.DatabaseConfig(ctx, req.Storage, role.DBName)
-		if err != nil {
-			return nil, err
-		}
+		return b.createCredentials(ctx, req, name, role)
+	}
+}
 
-		// If role name isn't in the database's allowed roles, send back a
-		// permission denied.
-		if !strutil.StrListContains(dbConfig.AllowedRoles, "*") && !strutil.StrListContainsGlob(dbConfig.AllowedRoles, name) {
-			return nil, fmt.Errorf("%q is not an allowed role", name)
+// createCredentials creates a database user for a role, returning it as a lease
+func (b *databaseBackend) createCredentials(ctx context.Context, req *logical.Request, name string, role *roleEntry) (*logical.Response, error) {
+	if role.kubernetesName != nil {
+		// A performance standby cannot track the lease, so the request is forwarded to the
+		// active node of its cluster
+		if b.System().ReplicationState().HasState(consts.ReplicationPerformanceStandby) {
+			return nil, logical.ErrReadOnly
 		}
-
-		// Get the Database object
-		db, err := b.GetConnection(ctx, req.Storage, role.DBName)
-		if err != nil {
-			return nil, err
+		if resp, err := b.checkServiceAccountBinding(ctx, req, role.kubernetesName, role.BindServiceAccount); resp != nil || err != nil {
+			return resp, err
 		}
+	}
 
-		db.RLock()
-		defer db.RUnlock()
+	dbConfig, err := b.DatabaseConfig(ctx, req.Storage, role.DBName)
+	if err != nil {
+		return nil, err
+	}
 
-		ttl, _, err := framework.CalculateTTL(b.System(), 0, role.DefaultTTL, 0, role.MaxTTL, 0, time.Time{})
-		if err != nil {
-			return nil, err
-		}
-		expiration := time.Now().Add(ttl)
-		// Adding a small buffer since the TTL will be calculated again after this call
-		// to ensure the database credential does not expire before the lease
-		expiration = expiration.Add(5 * time.Second)
-
-		usernameConfig := dbplugin.UsernameConfig{
-			DisplayName: req.DisplayName,
-			RoleName:    name,
-		}
+	// If role name isn't in the database's allowed roles, send back a
+	// permission denied.
+	if !strutil.StrListContains(dbConfig.AllowedRoles, "*") && !strutil.StrListContainsGlob(dbConfig.AllowedRoles, name) {
+		return nil, fmt.Errorf("%q is not an allowed role", name)
+	}
+
+	// Get the Database object
+	db, err := b.GetConnection(ctx, req.Storage, role.DBName)
+	if err != nil {
+		return nil, err
+	}
+
+	db.RLock()
+	defer db.RUnlock()
+
+	ttl, _, err := framework.CalculateTTL(b.System(), 0, role.DefaultTTL, 0, role.MaxTTL, 0, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	expiration := time.Now().Add(ttl)
+	// Adding a small buffer since the TTL will be calculated again after this call
+	// to ensure the database credential does not expire before the lease
+	expiration = expiration.Add(5 * time.Second)
+
+	usernameConfig := dbplugin.UsernameConfig{
+		DisplayName: req.DisplayName,
+		RoleName:    name,
+	}
+
+	// Create the user
+	username, password, err := db.CreateUser(ctx, role.Statements, usernameConfig, expiration)
+	if err != nil {
+		b.CloseIfShutdown(db, err)
+		return nil, err
+	}
+
+	internalData := map[string]interface{}{
+		"username":              username,
+		"role":                  name,
+		"db_name":               role.DBName,
+		"revocation_statements": role.Statements.Revocation,
+	}
+
+	if k8sName := role.kubernetesName; k8sName != nil {
+		// The components of the virtual role are stored with the lease, so that it can
+		// be resolved again on renewal without parsing its name
+		internalData["k8s_cluster"] = k8sName.Cluster
+		internalData["k8s_role"] = k8sName.Role
+		internalData["k8s_namespace"] = k8sName.Namespace
+		internalData["k8s_service_account"] = k8sName.ServiceAccount
+	}
 
-		// Create the user
-		username, password, err := db.CreateUser(ctx, role.Statements, usernameConfig, expiration)
+	// Remember the credentials against the service account, so that they can be revoked if
+	// the service account is deleted or re-annotated. Tracked leases are replicated storage,
+	// so credentials issued on a performance secondary, whose leases are local to it, are not
+	// tracked and stay valid until their lease expires.
+	if k8sName := role.kubernetesName; k8sName != nil && writesReplicatedStorage(b.System()) {
+		first, err := b.trackLease(ctx, req.Storage, k8sName, role, username, expiration)
 		if err != nil {
-			b.CloseIfShutdown(db, err)
-			return nil, err
+			// Credentials which are not tracked could outlive the service account's mapping,
+			// so they are not issued
+			if err := db.RevokeUser(ctx, role.Statements, username); err != nil {
+				b.CloseIfShutdown(db, err)
+				b.logger.Error("error revoking user which could not be tracked", "role", name, "username", username, "error", err)
+			}
+			return nil, errwrap.Wrapf("error tracking lease of service account: {{err}}", err)
+		}
+		if first {
+			b.recordServiceAccountEvent(k8sName.Cluster, k8sName.Namespace, k8sName.ServiceAccount, v1.EventTypeNormal, eventReasonCredentialsIssued,
+				fmt.Sprintf("Vault issued database user %s of role %s for keyspaces %s", username, name, strings.Join(role.kubernetesMapping.keyspaces(), ",")))
 		}
-
-		resp := b.Secret(SecretCredsType).Response(map[string]interface{}{
-			"username": username,
-			"password": password,
-		}, map[string]interface{}{
-			"username":              username,
-			"role":                  name,
-			"db_name":               role.DBName,
-			"revocation_statements": role.Statements.Revocation,
-		})
-		resp.Secret.TTL = role.DefaultTTL
-		resp.Secret.MaxTTL = role.MaxTTL
-		return resp, nil
 	}
+
+	// The revocation statements are stored with the lease; for virtual k8s roles they
+	// have already been interpolated with the service account's annotations
+	resp := b.Secret(SecretCredsType).Response(map[string]interface{}{
+		"username": username,
+		"password": password,
+	}, internalData)
+	resp.Secret.TTL = role.DefaultTTL
+	resp.Secret.MaxTTL = role.MaxTTL
+	return resp, nil
 }
 
 func (b *databaseBackend) pathStaticCredsRead() framework.OperationFunc {
 	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-		name := data.Get("name").(string)
+		return b.staticCredentials(ctx, req, data.Get("name").(string))
+	}
+}
 
-		role, err := b.StaticRole(ctx, req.Storage, name)
+// staticCredentials returns the current credentials of a static role
+func (b *databaseBackend) staticCredentials(ctx context.Context, req *logical.Request, name string) (*logical.Response, error) {
+	role, err := b.StaticRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse("unknown role: %s", name), nil
+	}
+	if role.StaticAccount.KubernetesTemplate {
+		return logical.ErrorResponse("%s is a template and has no credentials of its own", name), nil
+	}
+	if role.StaticAccount.KubernetesMapping != nil {
+		k8sName, err := parseKubernetesRoleName(name)
 		if err != nil {
 			return nil, err
 		}
-		if role == nil {
-			return logical.ErrorResponse("unknown role: %s", name), nil
-		}
-
-		dbConfig, err := b.DatabaseConfig(ctx, req.Storage, role.DBName)
-		if err != nil {
-			return nil, err
+		if resp, err := b.checkServiceAccountBinding(ctx, req, k8sName, role.BindServiceAccount); resp != nil || err != nil {
+			return resp, err
 		}
+	}
 
-		// If role name isn't in the database's allowed roles, send back a
-		// permission denied.
-		if !strutil.StrListContains(dbConfig.AllowedRoles, "*") && !strutil.StrListContainsGlob(dbConfig.AllowedRoles, name) {
-			return nil, fmt.Errorf("%q is not an allowed role", name)
-		}
+	dbConfig, err := b.DatabaseConfig(ctx, req.Storage, role.DBName)
+	if err != nil {
+		return nil, err
+	}
 
-		return &logical.Response{
-			Data: map[string]interface{}{
-				"username":            role.StaticAccount.Username,
-				"password":            role.StaticAccount.Password,
-				"ttl":                 role.StaticAccount.PasswordTTL().Seconds(),
-				"rotation_period":     role.StaticAccount.RotationPeriod.Seconds(),
-				"last_vault_rotation": role.StaticAccount.LastVaultRotation,
-			},
-		}, nil
+	// If role name isn't in the database's allowed roles, send back a
+	// permission denied.
+	if !strutil.StrListContains(dbConfig.AllowedRoles, "*") && !strutil.StrListContainsGlob(dbConfig.AllowedRoles, name) {
+		return nil, fmt.Errorf("%q is not an allowed role", name)
 	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"username":            role.StaticAccount.Username,
+			"password":            role.StaticAccount.Password,
+			"ttl":                 role.StaticAccount.PasswordTTL().Seconds(),
+			"rotation_period":     role.StaticAccount.RotationPeriod.Seconds(),
+			"last_vault_rotation": role.StaticAccount.LastVaultRotation,
+		},
+	}, nil
 }
 
 const pathCredsCreateReadHelpSyn = `
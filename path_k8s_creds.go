@@ -0,0 +1,236 @@
+package database
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// pathKubernetesCreds returns the paths addressing a virtual role by its components, rather
+// than by an underscore separated name. They fit ACL templating, eg
+// k8s-creds/rw/{{identity.entity.aliases.<accessor>.metadata.service_account_namespace}}/...
+// A named cluster is the first segment, k8s-creds/<cluster>/<role>/..., rather than a
+// parameter, so that policies can restrict it too.
+func pathKubernetesCreds(b *databaseBackend) []*framework.Path {
+	fields := func(roleDescription string) map[string]*framework.FieldSchema {
+		return map[string]*framework.FieldSchema{
+			"role": {
+				Type:        framework.TypeString,
+				Description: roleDescription,
+			},
+			"namespace": {
+				Type:        framework.TypeString,
+				Description: "Namespace of the service account.",
+			},
+			"service_account": {
+				Type:        framework.TypeString,
+				Description: "Name of the service account.",
+			},
+			"cluster": {
+				Type:        framework.TypeString,
+				Description: "Name of the Kubernetes cluster, given as the first path segment. If omitted, uses the default cluster.",
+			},
+		}
+	}
+
+	pattern := func(prefix string) string {
+		return prefix + "(" + framework.GenericNameRegex("cluster") + "/)?" + framework.GenericNameRegex("role") + "/" + framework.GenericNameRegex("namespace") + "/" + framework.GenericNameRegex("service_account") + "$"
+	}
+
+	return []*framework.Path{
+		{
+			Pattern: pattern("k8s-creds/"),
+			Fields:  fields("Name of the concrete role."),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathKubernetesCredsRead(),
+			},
+
+			HelpSynopsis:    pathKubernetesCredsHelpSyn,
+			HelpDescription: pathKubernetesCredsHelpDesc,
+		},
+		{
+			Pattern: "k8s-self-creds/(" + framework.GenericNameRegex("cluster") + "/)?" + framework.GenericNameRegex("role") + "$",
+			Fields: map[string]*framework.FieldSchema{
+				"role": {
+					Type:        framework.TypeString,
+					Description: "Name of the concrete role.",
+				},
+				"cluster": {
+					Type:        framework.TypeString,
+					Description: "Name of the Kubernetes cluster, given as the first path segment. If omitted, uses the default cluster.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathKubernetesSelfCredsRead(),
+			},
+
+			HelpSynopsis:    pathKubernetesSelfCredsHelpSyn,
+			HelpDescription: pathKubernetesSelfCredsHelpDesc,
+		},
+		{
+			Pattern: pattern("k8s-roles/"),
+			Fields:  fields("Name of the concrete role."),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathKubernetesRoleRead(),
+			},
+
+			HelpSynopsis:    pathKubernetesRoleHelpSyn,
+			HelpDescription: pathKubernetesRoleHelpDesc,
+		},
+		{
+			Pattern: pattern("k8s-static-creds/"),
+			Fields:  fields("Name of the template static role."),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathKubernetesStaticCredsRead(),
+			},
+
+			HelpSynopsis:    pathKubernetesStaticCredsHelpSyn,
+			HelpDescription: pathKubernetesStaticCredsHelpDesc,
+		},
+	}
+}
+
+func kubernetesRoleNameFromFields(data *framework.FieldData) *k8sRoleName {
+	return &k8sRoleName{
+		Cluster:        data.Get("cluster").(string),
+		Role:           data.Get("role").(string),
+		Namespace:      data.Get("namespace").(string),
+		ServiceAccount: data.Get("service_account").(string),
+	}
+}
+
+// pathKubernetesCredsRead issues credentials for a concrete role applied to a service account
+func (b *databaseBackend) pathKubernetesCredsRead() framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		k8sName := kubernetesRoleNameFromFields(data)
+
+		role, err := b.resolveKubernetesRole(ctx, req.Storage, k8sName, databaseRolePath)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			return logical.ErrorResponse("unknown role %s, or service account %s/%s is not annotated", k8sName.Role, k8sName.Namespace, k8sName.ServiceAccount), nil
+		}
+
+		return b.createCredentials(ctx, req, k8sName.String(), role)
+	}
+}
+
+// pathKubernetesSelfCredsRead issues credentials for a concrete role applied to the service
+// account the caller logged in as
+func (b *databaseBackend) pathKubernetesSelfCredsRead() framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		cluster := data.Get("cluster").(string)
+
+		config, err := b.kubeconfig(ctx, req.Storage, cluster)
+		if err != nil {
+			return nil, err
+		}
+
+		accounts, err := b.callerServiceAccounts(ctx, req, cluster, config)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		if len(accounts) > 1 {
+			return logical.ErrorResponse("identity entity has aliases for %d service accounts; set auth_mount_accessor on the kubeconfig to choose one", len(accounts)), nil
+		}
+
+		k8sName := &k8sRoleName{
+			Cluster:        cluster,
+			Role:           data.Get("role").(string),
+			Namespace:      accounts[0].Namespace,
+			ServiceAccount: accounts[0].Name,
+		}
+
+		role, err := b.resolveKubernetesRole(ctx, req.Storage, k8sName, databaseRolePath)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			return logical.ErrorResponse("unknown role %s, or service account %s/%s is not annotated", k8sName.Role, k8sName.Namespace, k8sName.ServiceAccount), nil
+		}
+
+		return b.createCredentials(ctx, req, k8sName.String(), role)
+	}
+}
+
+// pathKubernetesRoleRead previews a concrete role as it would be applied to a service account
+func (b *databaseBackend) pathKubernetesRoleRead() framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		k8sName := kubernetesRoleNameFromFields(data)
+
+		role, err := b.resolveKubernetesRole(ctx, req.Storage, k8sName, databaseRolePath)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		if role == nil {
+			return nil, nil
+		}
+
+		resp := &logical.Response{
+			Data: roleResponseData(role),
+		}
+		resp.Data["name"] = k8sName.String()
+		resp.Data["keyspaces"] = role.kubernetesMapping.keyspaces()
+		resp.Data["keyspace_level"] = mappingLevel(role.kubernetesMapping.KeyspaceLevel)
+		resp.Data["db_name_level"] = mappingLevel(role.kubernetesMapping.DBNameLevel)
+
+		return resp, nil
+	}
+}
+
+// pathKubernetesStaticCredsRead reads the credentials of the static role provisioned from a
+// template for a service account
+func (b *databaseBackend) pathKubernetesStaticCredsRead() framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		return b.staticCredentials(ctx, req, kubernetesRoleNameFromFields(data).String())
+	}
+}
+
+const pathKubernetesCredsHelpSyn = `
+Request database credentials for a concrete role applied to a service account.
+`
+
+const pathKubernetesCredsHelpDesc = `
+This path is equivalent to reading creds/k8s_<role>_<service_account>_<namespace>,
+but takes the concrete role, namespace and service account as separate path
+segments, so that a concrete role may contain underscores. A service account
+in a named cluster is read from k8s-creds/<cluster>/<role>/<namespace>/<service_account>.
+`
+
+const pathKubernetesSelfCredsHelpSyn = `
+Request database credentials for a concrete role applied to the caller's service account.
+`
+
+const pathKubernetesSelfCredsHelpDesc = `
+This path issues credentials like k8s-creds/<role>/<namespace>/<service_account>, where
+the namespace and service account are those the caller logged in as through the
+kubernetes auth method, read from the metadata of its identity entity's alias. A
+single policy granting read on k8s-self-creds/<role> therefore covers every service.
+
+A named cluster is read from k8s-self-creds/<cluster>/<role>. Unless only the default
+cluster is configured, the cluster's kubeconfig must set "auth_mount_accessor", so that
+only aliases of the auth mount of that cluster are accepted.
+`
+
+const pathKubernetesRoleHelpSyn = `
+Preview a concrete role applied to a service account.
+`
+
+const pathKubernetesRoleHelpDesc = `
+This path returns the statements and database a concrete role would use for a
+service account, after its annotations have been interpolated, without issuing
+credentials. The name of the equivalent virtual role is returned as "name".
+A named cluster is given as the first segment, like k8s-creds/<cluster>/...
+`
+
+const pathKubernetesStaticCredsHelpSyn = `
+Request the credentials of a static role provisioned for a service account.
+`
+
+const pathKubernetesStaticCredsHelpDesc = `
+This path is equivalent to reading static-creds/k8s_<template>_<service_account>_<namespace>,
+where the static role was provisioned from a template for the service account.
+A named cluster is given as the first segment, like k8s-creds/<cluster>/...
+`
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// pathKubeconfigReconcile returns the path reconciling the stored service account mapping of
+// a cluster on demand
+func pathKubeconfigReconcile(b *databaseBackend) []*framework.Path {
+	return []*framework.Path{{
+		Pattern: "kubeconfig(/" + framework.GenericNameRegex("name") + ")?/reconcile$",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of the Kubernetes cluster. If omitted, reconciles the default cluster.",
+			},
+			"force": {
+				Type:        framework.TypeBool,
+				Description: "Delete stored mappings and provisioned static roles even if there are more than max_deletions_per_sync.",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathKubeconfigReconcileWrite(),
+		},
+
+		HelpSynopsis:    kubeconfigReconcileHelpSyn,
+		HelpDescription: kubeconfigReconcileHelpDesc,
+	}}
+}
+
+func (b *databaseBackend) pathKubeconfigReconcileWrite() framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		cluster := data.Get("name").(string)
+
+		config, err := b.kubeconfig(ctx, req.Storage, cluster)
+		if err != nil {
+			return nil, err
+		}
+		if config == nil {
+			return logical.ErrorResponse("no kubeconfig for cluster %q", clusterDisplayName(cluster)), nil
+		}
+
+		if config.grantsFromResources() {
+			return logical.ErrorResponse("cluster %q grants access through DatabaseAccess resources, which have no stored mapping", clusterDisplayName(cluster)), nil
+		}
+
+		w := b.watcher(cluster)
+		if w == nil {
+			return logical.ErrorResponse("cluster %q is not being watched", clusterDisplayName(cluster)), nil
+		}
+		if !w.status.hasSynced() {
+			return logical.ErrorResponse("the watcher of cluster %q has not completed its initial list", clusterDisplayName(cluster)), nil
+		}
+
+		mappings, err := b.serviceAccountMappings(config, w, w.cache.List())
+		if err != nil {
+			return nil, err
+		}
+
+		force := data.Get("force").(bool)
+		if err := b.reconcileServiceAccounts(ctx, req.Storage, cluster, config, w, mappings, force); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+
+		if writesReplicatedStorage(b.System()) {
+			if err := b.provisionStaticRoles(ctx, req.Storage, cluster, config, mappings, force); err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+		}
+
+		return nil, nil
+	}
+}
+
+const kubeconfigReconcileHelpSyn = `Reconciles the stored service account mapping of a cluster.`
+const kubeconfigReconcileHelpDesc = `
+Writes the mapping of every annotated service account in the watcher's cache to
+Vault storage, and tombstones or deletes the stored mappings of service
+accounts which are no longer annotated, as the periodic sync does. Static roles
+provisioned from templates are also brought up to date, and those of service
+accounts which are no longer annotated are removed after revoking their users.
+
+A sync refuses to delete anything if more than max_deletions_per_sync stored
+mappings or provisioned static roles would be deleted, as that usually means the watcher is pointed at the
+wrong cluster or saw a partial list. Once the cause has been checked, writing
+force=true to this path performs the deletions.
+
+Writing to "kubeconfig/reconcile" reconciles the default cluster, and
+"kubeconfig/<name>/reconcile" a named cluster.
+`
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// pathKubeconfigStatus returns the path reporting the health of the service account watchers
+func pathKubeconfigStatus(b *databaseBackend) []*framework.Path {
+	return []*framework.Path{{
+		Pattern: "kubeconfig(/" + framework.GenericNameRegex("name") + ")?/status$",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of the Kubernetes cluster. If omitted, reports on the default cluster.",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathKubeconfigStatusRead(),
+		},
+
+		HelpSynopsis:    kubeconfigStatusHelpSyn,
+		HelpDescription: kubeconfigStatusHelpDesc,
+	}}
+}
+
+func (b *databaseBackend) pathKubeconfigStatusRead() framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		cluster := data.Get("name").(string)
+
+		config, err := b.kubeconfig(ctx, req.Storage, cluster)
+		if err != nil {
+			return nil, err
+		}
+		if config == nil {
+			return logical.ErrorResponse("no kubeconfig for cluster %q", clusterDisplayName(cluster)), nil
+		}
+
+		w := b.watcher(cluster)
+		if w == nil {
+			return &logical.Response{
+				Data: map[string]interface{}{
+					"watching": false,
+				},
+			}, nil
+		}
+
+		return &logical.Response{
+			Data: w.statusData(),
+		}, nil
+	}
+}
+
+const kubeconfigStatusHelpSyn = `Reports the status of the Kubernetes service account watcher.`
+const kubeconfigStatusHelpDesc = `
+Reports whether the reflector watching service accounts has completed its
+initial list, the last resource version, watch event and relist it observed,
+the number of cached service accounts, the last error returned by the Kubernetes
+API and the time of the last successful call, and the time and outcome of the
+last sync of the mapping into Vault storage.
+
+Reading "kubeconfig/status" reports on the default cluster, and
+"kubeconfig/<name>/status" on a named cluster.
+`
@@ -87,6 +87,25 @@ func fieldsForType(roleType string) map[string]*framework.FieldSchema {
 			Type:        framework.TypeString,
 			Description: "Name of the database this role acts on.",
 		},
+		"allowed_db_name_overrides": {
+			Type: framework.TypeCommaStringSlice,
+			Description: `Comma separated list or JSON array of the database
+	names, which may be globs, that a service account's db name annotation
+	may redirect this role to. If empty, any database may be used.`,
+		},
+		"annotation_pattern": {
+			Type: framework.TypeString,
+			Description: `Regular expression which the keyspaces and template
+	variable values of a service account must match to be interpolated into
+	this role's statements. It must match the whole value, whether or not it
+	is anchored. If empty, the kubeconfig's annotation_pattern is used.`,
+		},
+		"bind_service_account": {
+			Type: framework.TypeBool,
+			Description: `If true, credentials for a service account can only
+	be read by a client which logged in as that service account through the
+	kubernetes auth method.`,
+		},
 	}
 
 	// Get the fields that are specific to the type of role, and add them to the
@@ -170,6 +189,25 @@ func staticFields() map[string]*framework.FieldSchema {
 	this functionality. See the plugin's API page for more information on
 	support and formatting for this parameter.`,
 		},
+		"kubernetes_template": {
+			Type: framework.TypeBool,
+			Description: `If true, this static role is not rotated itself, but
+	is used as a template to provision a static role for every annotated
+	Kubernetes service account. The username and statements are
+	interpolated with the service account's annotations.`,
+		},
+		"creation_statements": {
+			Type: framework.TypeStringSlice,
+			Description: `Specifies the database statements executed to create
+	the user of a static role provisioned from this template. Only valid with
+	"kubernetes_template".`,
+		},
+		"revocation_statements": {
+			Type: framework.TypeStringSlice,
+			Description: `Specifies the database statements executed to drop
+	the user of a static role provisioned from this template, once its service
+	account is no longer annotated. Only valid with "kubernetes_template".`,
+		},
 	}
 	return fields
 }
@@ -230,6 +268,13 @@ func (b *databaseBackend) pathStaticRoleRead(ctx context.Context, req *logical.R
 	data := map[string]interface{}{
 		"db_name":             role.DBName,
 		"rotation_statements": role.Statements.Rotation,
+
+		"allowed_db_name_overrides": role.AllowedDBNameOverrides,
+		"bind_service_account":      role.BindServiceAccount,
+		"annotation_pattern":        role.AnnotationPattern,
+	}
+	if len(role.AllowedDBNameOverrides) == 0 {
+		data["allowed_db_name_overrides"] = []string{}
 	}
 
 	// guard against nil StaticAccount; shouldn't happen but we'll be safe
@@ -237,6 +282,11 @@ func (b *databaseBackend) pathStaticRoleRead(ctx context.Context, req *logical.R
 		data["username"] = role.StaticAccount.Username
 		data["rotation_statements"] = role.Statements.Rotation
 		data["rotation_period"] = role.StaticAccount.RotationPeriod.Seconds()
+		data["kubernetes_template"] = role.StaticAccount.KubernetesTemplate
+		if role.StaticAccount.KubernetesTemplate || role.StaticAccount.KubernetesMapping != nil {
+			data["creation_statements"] = role.Statements.Creation
+			data["revocation_statements"] = role.Statements.Revocation
+		}
 		if !role.StaticAccount.LastVaultRotation.IsZero() {
 			data["last_vault_rotation"] = role.StaticAccount.LastVaultRotation
 		}
@@ -260,6 +310,13 @@ func (b *databaseBackend) pathRoleRead(ctx context.Context, req *logical.Request
 		return nil, nil
 	}
 
+	return &logical.Response{
+		Data: roleResponseData(role),
+	}, nil
+}
+
+// roleResponseData renders a dynamic role for an API response
+func roleResponseData(role *roleEntry) map[string]interface{} {
 	data := map[string]interface{}{
 		"db_name":               role.DBName,
 		"creation_statements":   role.Statements.Creation,
@@ -268,6 +325,13 @@ func (b *databaseBackend) pathRoleRead(ctx context.Context, req *logical.Request
 		"renew_statements":      role.Statements.Renewal,
 		"default_ttl":           role.DefaultTTL.Seconds(),
 		"max_ttl":               role.MaxTTL.Seconds(),
+
+		"allowed_db_name_overrides": role.AllowedDBNameOverrides,
+		"bind_service_account":      role.BindServiceAccount,
+		"annotation_pattern":        role.AnnotationPattern,
+	}
+	if len(role.AllowedDBNameOverrides) == 0 {
+		data["allowed_db_name_overrides"] = []string{}
 	}
 	if len(role.Statements.Creation) == 0 {
 		data["creation_statements"] = []string{}
@@ -282,9 +346,7 @@ func (b *databaseBackend) pathRoleRead(ctx context.Context, req *logical.Request
 		data["renew_statements"] = []string{}
 	}
 
-	return &logical.Response{
-		Data: data,
-	}, nil
+	return data
 }
 
 func (b *databaseBackend) pathRoleList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
@@ -334,6 +396,21 @@ func (b *databaseBackend) pathRoleCreateUpdate(ctx context.Context, req *logical
 		if role.DBName == "" {
 			return logical.ErrorResponse("database name is required"), nil
 		}
+
+		if overridesRaw, ok := data.GetOk("allowed_db_name_overrides"); ok {
+			role.AllowedDBNameOverrides = strutil.RemoveEmpty(overridesRaw.([]string))
+		}
+
+		if bindRaw, ok := data.GetOk("bind_service_account"); ok {
+			role.BindServiceAccount = bindRaw.(bool)
+		}
+
+		if patternRaw, ok := data.GetOk("annotation_pattern"); ok {
+			role.AnnotationPattern = patternRaw.(string)
+			if _, err := compileAnnotationPattern(role.AnnotationPattern); err != nil {
+				return logical.ErrorResponse("invalid annotation_pattern: %s", err), nil
+			}
+		}
 	}
 
 	// Statements
@@ -445,6 +522,21 @@ func (b *databaseBackend) pathStaticRoleCreateUpdate(ctx context.Context, req *l
 		return logical.ErrorResponse("database name is a required field"), nil
 	}
 
+	if overridesRaw, ok := data.GetOk("allowed_db_name_overrides"); ok {
+		role.AllowedDBNameOverrides = strutil.RemoveEmpty(overridesRaw.([]string))
+	}
+
+	if bindRaw, ok := data.GetOk("bind_service_account"); ok {
+		role.BindServiceAccount = bindRaw.(bool)
+	}
+
+	if patternRaw, ok := data.GetOk("annotation_pattern"); ok {
+		role.AnnotationPattern = patternRaw.(string)
+		if _, err := compileAnnotationPattern(role.AnnotationPattern); err != nil {
+			return logical.ErrorResponse("invalid annotation_pattern: %s", err), nil
+		}
+	}
+
 	username := data.Get("username").(string)
 	if username == "" && createRole {
 		return logical.ErrorResponse("username is a required field to create a static account"), nil
@@ -477,6 +569,53 @@ func (b *databaseBackend) pathStaticRoleCreateUpdate(ctx context.Context, req *l
 		role.Statements.Rotation = data.Get("rotation_statements").([]string)
 	}
 
+	if templateRaw, ok := data.GetOk("kubernetes_template"); ok {
+		role.StaticAccount.KubernetesTemplate = templateRaw.(bool)
+	}
+
+	if creationStmtsRaw, ok := data.GetOk("creation_statements"); ok {
+		role.Statements.Creation = strutil.RemoveEmpty(creationStmtsRaw.([]string))
+	}
+	if revocationStmtsRaw, ok := data.GetOk("revocation_statements"); ok {
+		role.Statements.Revocation = strutil.RemoveEmpty(revocationStmtsRaw.([]string))
+	}
+
+	if !role.StaticAccount.KubernetesTemplate && role.StaticAccount.KubernetesMapping == nil && (len(role.Statements.Creation) > 0 || len(role.Statements.Revocation) > 0) {
+		return logical.ErrorResponse("creation_statements and revocation_statements are only valid with kubernetes_template"), nil
+	}
+
+	// Templates are never rotated themselves. Instead, a static role is provisioned from
+	// them for each annotated service account the next time service accounts are synced.
+	if role.StaticAccount.KubernetesTemplate {
+		if len(role.Statements.Creation) == 0 || len(role.Statements.Rotation) == 0 {
+			return logical.ErrorResponse("creation_statements and rotation_statements are required for a kubernetes_template"), nil
+		}
+		// A service account may be granted several keyspaces, but a static role has one user
+		if strings.Contains(role.StaticAccount.Username, "{{annotation}}") {
+			return logical.ErrorResponse("the username of a kubernetes_template cannot refer to {{annotation}}"), nil
+		}
+
+		cluster, ok, err := b.clusterGrantingFromResources(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return logical.ErrorResponse("static role templates are not supported while the kubeconfig of cluster %q has grant_source %q", clusterDisplayName(cluster), grantSourceDatabaseAccess), nil
+		}
+
+		entry, err := logical.StorageEntryJSON(databaseStaticRolePath+name, role)
+		if err != nil {
+			return nil, err
+		}
+		if err := req.Storage.Put(ctx, entry); err != nil {
+			return nil, err
+		}
+
+		b.popFromRotationQueueByKey(name)
+
+		return nil, nil
+	}
+
 	// lvr represents the roles' LastVaultRotation
 	lvr := role.StaticAccount.LastVaultRotation
 
@@ -527,6 +666,23 @@ type roleEntry struct {
 	DefaultTTL    time.Duration       `json:"default_ttl"`
 	MaxTTL        time.Duration       `json:"max_ttl"`
 	StaticAccount *staticAccount      `json:"static_account" mapstructure:"static_account"`
+
+	// AllowedDBNameOverrides are the database names a service account's db name annotation
+	// may redirect a concrete role to. Any database may be used if it is empty.
+	AllowedDBNameOverrides []string `json:"allowed_db_name_overrides,omitempty"`
+
+	// BindServiceAccount restricts the credentials of a service account to clients which
+	// logged in as it
+	BindServiceAccount bool `json:"bind_service_account,omitempty"`
+
+	// AnnotationPattern is the pattern values of a service account must match to be
+	// interpolated into the statements. The kubeconfig's pattern is used if it is empty.
+	AnnotationPattern string `json:"annotation_pattern,omitempty"`
+
+	// kubernetesName and kubernetesMapping are the virtual role and service account mapping
+	// a virtual k8s role was resolved from. They are never stored.
+	kubernetesName    *k8sRoleName
+	kubernetesMapping *saCacheObject
 }
 
 type staticAccount struct {
@@ -549,6 +705,16 @@ type staticAccount struct {
 	// RevokeUser is a boolean flag to indicate if Vault should revoke the
 	// database user when the role is deleted
 	RevokeUserOnDelete bool `json:"revoke_user_on_delete"`
+
+	// KubernetesTemplate marks this static account as a template from which a
+	// static account is provisioned for each annotated service account. Templates
+	// are not rotated.
+	KubernetesTemplate bool `json:"kubernetes_template"`
+
+	// KubernetesMapping is the service account mapping a static account was
+	// provisioned with, if it was provisioned from a template. It is compared
+	// against the current mapping to detect when the account must be reprovisioned.
+	KubernetesMapping *saCacheObject `json:"kubernetes_mapping,omitempty"`
 }
 
 // NextRotationTime calculates the next rotation by adding the Rotation Period
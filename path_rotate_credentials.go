@@ -111,6 +111,9 @@ func (b *databaseBackend) pathRotateRoleCredentialsUpdate() framework.OperationF
 		if role == nil {
 			return logical.ErrorResponse("no static role found for role name"), nil
 		}
+		if role.StaticAccount.KubernetesTemplate {
+			return logical.ErrorResponse("static role is a template and cannot be rotated"), nil
+		}
 
 		// In create/update of static accounts, we only care if the operation
 		// err'd , and this call does not return credentials
@@ -0,0 +1,187 @@
+package database
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// pathServiceAccounts returns the paths used to inspect the service account mapping
+func pathServiceAccounts(b *databaseBackend) []*framework.Path {
+	clusterField := &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Name of the Kubernetes cluster. If omitted, uses the default cluster.",
+	}
+
+	return []*framework.Path{
+		{
+			Pattern: "serviceaccounts/?$",
+			Fields: map[string]*framework.FieldSchema{
+				"cluster": clusterField,
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathServiceAccountsList(),
+			},
+
+			HelpSynopsis:    pathServiceAccountsHelpSyn,
+			HelpDescription: pathServiceAccountsHelpDesc,
+		},
+		{
+			Pattern: "serviceaccounts/" + framework.GenericNameRegex("namespace") + "/?$",
+			Fields: map[string]*framework.FieldSchema{
+				"cluster": clusterField,
+				"namespace": {
+					Type:        framework.TypeString,
+					Description: "Namespace of the service accounts.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathServiceAccountsList(),
+			},
+
+			HelpSynopsis:    pathServiceAccountsHelpSyn,
+			HelpDescription: pathServiceAccountsHelpDesc,
+		},
+		{
+			Pattern: "serviceaccounts/" + framework.GenericNameRegex("namespace") + "/" + framework.GenericNameRegex("name") + "$",
+			Fields: map[string]*framework.FieldSchema{
+				"cluster": clusterField,
+				"namespace": {
+					Type:        framework.TypeString,
+					Description: "Namespace of the service account.",
+				},
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the service account.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathServiceAccountRead(),
+			},
+
+			HelpSynopsis:    pathServiceAccountsHelpSyn,
+			HelpDescription: pathServiceAccountsHelpDesc,
+		},
+	}
+}
+
+// pathServiceAccountsList lists namespaces containing mapped service accounts, or the mapped
+// service accounts within a namespace
+func (b *databaseBackend) pathServiceAccountsList() framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		cluster := data.Get("cluster").(string)
+
+		var namespace string
+		if namespaceRaw, ok := data.GetOk("namespace"); ok {
+			namespace = namespaceRaw.(string)
+		}
+
+		keys, err := b.mappedServiceAccounts(ctx, req.Storage, cluster)
+		if err != nil {
+			return nil, err
+		}
+
+		var entries []string
+		seen := map[string]struct{}{}
+		for _, key := range keys {
+			subs := strings.SplitN(key, "/", 2)
+			if len(subs) != 2 {
+				continue
+			}
+
+			entry := subs[0] + "/"
+			if namespace != "" {
+				if subs[0] != namespace {
+					continue
+				}
+				entry = subs[1]
+			}
+
+			if _, ok := seen[entry]; ok {
+				continue
+			}
+			seen[entry] = struct{}{}
+			entries = append(entries, entry)
+		}
+
+		return logical.ListResponse(entries), nil
+	}
+}
+
+// pathServiceAccountRead returns the mapping that would be used for a service account
+func (b *databaseBackend) pathServiceAccountRead() framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		cluster := data.Get("cluster").(string)
+		namespace := data.Get("namespace").(string)
+		name := data.Get("name").(string)
+
+		mapping, source, err := b.lookupServiceAccount(ctx, req.Storage, cluster, namespace, name)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		if mapping == nil {
+			return nil, nil
+		}
+
+		config, err := b.kubeconfig(ctx, req.Storage, cluster)
+		if err != nil {
+			return nil, err
+		}
+		pattern, err := annotationPattern(nil, config)
+		if err != nil {
+			return nil, err
+		}
+		rejected := mapping.rejectedValues(pattern)
+		if rejected == nil {
+			rejected = []string{}
+		}
+
+		resp := &logical.Response{
+			Data: map[string]interface{}{
+				"keyspace":  mapping.Keyspace,
+				"keyspaces": mapping.keyspaces(),
+				"db_name":   mapping.DBName,
+				"source":    source,
+
+				"keyspace_level": mappingLevel(mapping.KeyspaceLevel),
+				"db_name_level":  mappingLevel(mapping.DBNameLevel),
+
+				"annotation_pattern": config.annotationPattern(),
+				"rejected_values":    rejected,
+			},
+		}
+		if mapping.DeletedAt != nil {
+			resp.Data["deleted_at"] = mapping.DeletedAt.Format(time.RFC3339)
+		}
+
+		return resp, nil
+	}
+}
+
+const pathServiceAccountsHelpSyn = `Inspect the mapping of Kubernetes service accounts to annotation values.`
+const pathServiceAccountsHelpDesc = `
+Lists the namespaces and service accounts which have a keyspace annotation,
+and reads the keyspace and db_name used when resolving virtual roles for a
+service account.
+
+The "source" of a mapping is "cache" if the service account was found in the
+in-memory cache of the Kubernetes API, or "storage" if it was read from the
+copy persisted in Vault. A service account in the cache without a keyspace
+annotation is returned with an empty keyspace. A stored mapping whose service
+account has been deleted or unannotated is kept until the tombstone grace
+period passes, and reports when it was removed as "deleted_at". Virtual roles
+are not resolved from a tombstoned mapping.
+
+"keyspace_level" and "db_name_level" report whether each value was read from the
+service account ("serviceaccount") or, when namespace_defaults is enabled on the
+kubeconfig, from its namespace ("namespace").
+
+"rejected_values" lists the keyspaces and template variable values which do not
+match the kubeconfig's "annotation_pattern", returned as "annotation_pattern".
+They may still be used by a concrete role setting its own annotation_pattern.
+
+The optional "cluster" parameter selects a named cluster.
+`
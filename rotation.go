@@ -61,6 +61,10 @@ func (b *databaseBackend) populateQueue(ctx context.Context, s logical.Storage)
 			continue
 		}
 
+		if role == nil || role.StaticAccount == nil || role.StaticAccount.KubernetesTemplate {
+			continue
+		}
+
 		item := queue.Item{
 			Key:      roleName,
 			Priority: role.StaticAccount.LastVaultRotation.Add(role.StaticAccount.RotationPeriod).Unix(),
@@ -172,6 +176,10 @@ func (b *databaseBackend) rotateCredential(ctx context.Context, s logical.Storag
 		b.logger.Warn("role not found", "role", item.Key, "error", err)
 		return true
 	}
+	if role.StaticAccount == nil || role.StaticAccount.KubernetesTemplate {
+		b.logger.Warn("role is not rotatable", "role", item.Key)
+		return true
+	}
 
 	// If "now" is less than the Item priority, then this item does not need to
 	// be rotated
@@ -268,9 +276,11 @@ func (b *databaseBackend) findStaticWAL(ctx context.Context, s logical.Storage,
 }
 
 type setStaticAccountInput struct {
-	RoleName   string
-	Role       *roleEntry
-	Password   string
+	RoleName string
+	Role     *roleEntry
+	Password string
+	// CreateUser creates the user of a static role provisioned from a template with its creation
+	// statements, rather than rotating its password. Other static accounts must already exist.
 	CreateUser bool
 	WALID      string
 }
@@ -355,7 +365,12 @@ func (b *databaseBackend) setStaticAccount(ctx context.Context, s logical.Storag
 		}
 	}
 
-	_, password, err := db.SetCredentials(ctx, input.Role.Statements, config)
+	password := newPassword
+	if input.Role.StaticAccount.KubernetesMapping != nil {
+		err = setProvisionedCredentials(ctx, db, input.Role.Statements, config, input.CreateUser)
+	} else {
+		_, password, err = db.SetCredentials(ctx, input.Role.Statements, config)
+	}
 	if err != nil {
 		b.CloseIfShutdown(db, err)
 		return output, errwrap.Wrapf("error setting credentials: {{err}}", err)
@@ -36,7 +36,20 @@ func (b *databaseBackend) secretCredsRenew() framework.OperationFunc {
 			return nil, fmt.Errorf("could not find role with name: %q", req.Secret.InternalData["role"])
 		}
 
-		role, err := b.Role(ctx, req.Storage, roleNameRaw.(string))
+		leaseKey, lease, err := b.secretTrackedLease(ctx, req.Storage, req.Secret.InternalData, username)
+		if err != nil {
+			return nil, err
+		}
+		if lease != nil && lease.Revoked {
+			return nil, fmt.Errorf("credentials were revoked because the service account is no longer mapped to them")
+		}
+
+		var role *roleEntry
+		if _, ok := req.Secret.InternalData["k8s_role"]; ok {
+			role, err = b.resolveKubernetesRole(ctx, req.Storage, secretKubernetesRoleName(req.Secret.InternalData), databaseRolePath)
+		} else {
+			role, err = b.Role(ctx, req.Storage, roleNameRaw.(string))
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -68,6 +81,13 @@ func (b *databaseBackend) secretCredsRenew() framework.OperationFunc {
 				b.CloseIfShutdown(db, err)
 				return nil, err
 			}
+
+			if lease != nil {
+				lease.Expiration = expireTime
+				if err := putTrackedLease(ctx, req.Storage, leaseKey, lease); err != nil {
+					return nil, err
+				}
+			}
 		}
 		resp := &logical.Response{Secret: req.Secret}
 		resp.Secret.TTL = role.DefaultTTL
@@ -92,12 +112,33 @@ func (b *databaseBackend) secretCredsRevoke() framework.OperationFunc {
 			return nil, fmt.Errorf("no role name was provided")
 		}
 
+		leaseKey, lease, err := b.secretTrackedLease(ctx, req.Storage, req.Secret.InternalData, username)
+		if err != nil {
+			return nil, err
+		}
+		if lease != nil && lease.Revoked {
+			// the controller has already revoked the user from the database
+			if err := req.Storage.Delete(ctx, leaseKey); err != nil {
+				return nil, err
+			}
+			return nil, nil
+		}
+
 		var dbName string
 		var statements dbplugin.Statements
 
-		role, err := b.Role(ctx, req.Storage, roleNameRaw.(string))
-		if err != nil {
-			return nil, err
+		// Virtual k8s roles are resolved from a service account which may have since been
+		// deleted or re-annotated, so prefer the statements captured when the credentials
+		// were issued
+		var role *roleEntry
+		_, hasEmbeddedDBName := req.Secret.InternalData["db_name"]
+		_, hasEmbeddedStatements := req.Secret.InternalData["revocation_statements"]
+		if !isKubernetesRoleName(roleNameRaw.(string)) || !hasEmbeddedDBName || !hasEmbeddedStatements {
+			var err error
+			role, err = b.Role(ctx, req.Storage, roleNameRaw.(string))
+			if err != nil {
+				return nil, err
+			}
 		}
 		if role != nil {
 			dbName = role.DBName
@@ -140,6 +181,54 @@ func (b *databaseBackend) secretCredsRevoke() framework.OperationFunc {
 			b.CloseIfShutdown(db, err)
 			return nil, err
 		}
+
+		if lease != nil {
+			if err := req.Storage.Delete(ctx, leaseKey); err != nil {
+				return nil, err
+			}
+		}
 		return resp, nil
 	}
 }
+
+// secretKubernetesRoleName returns the virtual role credentials were issued for, or nil if they
+// were issued for a concrete role. Leases issued before the components of the virtual role were
+// recorded only hold its name.
+func secretKubernetesRoleName(internalData map[string]interface{}) *k8sRoleName {
+	if _, ok := internalData["k8s_role"]; ok {
+		str := func(key string) string {
+			value, _ := internalData[key].(string)
+			return value
+		}
+		return &k8sRoleName{
+			Cluster:        str("k8s_cluster"),
+			Role:           str("k8s_role"),
+			Namespace:      str("k8s_namespace"),
+			ServiceAccount: str("k8s_service_account"),
+		}
+	}
+
+	name, _ := internalData["role"].(string)
+	if !isKubernetesRoleName(name) {
+		return nil
+	}
+
+	k8sName, err := parseKubernetesRoleName(name)
+	if err != nil {
+		return nil
+	}
+	return k8sName
+}
+
+// secretTrackedLease returns the tracked lease of credentials issued for a virtual role, and
+// its storage key. A nil lease is returned for any other role, or if it is not tracked.
+func (b *databaseBackend) secretTrackedLease(ctx context.Context, s logical.Storage, internalData map[string]interface{}, username string) (string, *trackedLease, error) {
+	k8sName := secretKubernetesRoleName(internalData)
+	if k8sName == nil {
+		return "", nil, nil
+	}
+
+	key := trackedLeaseKey(k8sName, username)
+	lease, err := b.trackedLease(ctx, s, key)
+	return key, lease, err
+}